@@ -21,3 +21,17 @@ func (c *InMemoryCache) Put(key string, value any) error {
 	c.cache[key] = value
 	return nil
 }
+
+// Keys returns every key in the cache.
+func (c *InMemoryCache) Keys() []string {
+	keys := make([]string, 0, len(c.cache))
+	for k := range c.cache {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Delete removes the key from the cache, if it is there.
+func (c *InMemoryCache) Delete(key string) {
+	delete(c.cache, key)
+}
@@ -22,12 +22,25 @@ func NewRedis() Cache {
 }
 
 func (c *Redis) Get(key string) (any, bool) {
-	v, err := c.client.Get(context.Background(), key).Result()
+	v, ok, err := c.GetContext(context.Background(), key)
 	if err != nil {
 		return nil, false
 	}
 
-	return v, true
+	return v, ok
+}
+
+// GetContext is Get, telling a key that isn't there apart from Redis failing.
+func (c *Redis) GetContext(ctx context.Context, key string) (any, bool, error) {
+	v, err := c.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return v, true, nil
 }
 
 func (c *Redis) Put(key string, value any) error {
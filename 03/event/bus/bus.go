@@ -15,9 +15,13 @@ package bus
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
+	"time"
 
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec"
 	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
 )
 
@@ -46,14 +50,33 @@ func Register(name string, driver driver.Driver) {
 
 // Bus is the handle representation a number of connections to an event bus.
 type Bus struct {
-	connector driver.Connector
-	Topics    []driver.Topic
+	connector  driver.Connector
+	driverName string
+	pool       *connPool
+	codec      driver.Codec
+	metrics    driver.Metrics
+	dedupe     *dedupe
+	scheduler  ScheduleStore
+	publishMW  []PublishMiddleware
+	consumeMW  []ConsumeMiddleware
+	Topics     []driver.Topic
+
+	errorHandler ErrorHandler
+	propagator   Propagator
+	logger       Logger
+	payloadLimit int
+
+	subMu     sync.Mutex
 	cancelSub context.CancelFunc
+	subConn   driver.Conn
+	subDone   chan struct{}
 }
 
 // Open opens an event bus based on the driver name and driver specific
 // data source name, consisting of information needed to connect to the event bus.
-func Open(driverName string) (*Bus, error) {
+// An empty dsn leaves the driver to its defaults. The options configure the bus,
+// such as WithLogger.
+func Open(driverName, dsn string, opts ...Option) (*Bus, error) {
 	driversMu.RLock()
 	driverInstance, ok := drivers[driverName]
 	driversMu.RUnlock()
@@ -61,74 +84,276 @@ func Open(driverName string) (*Bus, error) {
 		return nil, fmt.Errorf("bus: unknown driver %q (forgotten import?)", driverName)
 	}
 
-	connector, err := driverInstance.OpenConnector()
+	var connector driver.Connector
+	var err error
+	if d, ok := driverInstance.(driver.DriverDSN); ok {
+		connector, err = d.OpenConnectorDSN(dsn)
+	} else if dsn != "" {
+		return nil, fmt.Errorf("bus: driver %q does not take a data source name", driverName)
+	} else {
+		connector, err = driverInstance.OpenConnector()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	bus := &Bus{
-		connector: connector,
+	b := OpenConnector(connector, opts...)
+	b.driverName = driverName
+	return b, nil
+}
+
+// OpenConnector opens an event bus using a connector, bypassing the registered
+// drivers and data source names altogether, the same as sql.OpenDB.
+func OpenConnector(connector driver.Connector, opts ...Option) *Bus {
+	e := &Bus{
+		connector:  connector,
+		pool:       newConnPool(connector),
+		codec:      codec.JSON,
+		metrics:    driver.NopMetrics{},
+		propagator: W3C{},
+		logger:     driver.StdLogger{},
+	}
+	for _, opt := range opts {
+		opt(e)
 	}
 
-	return bus, nil
+	e.logger = payloads{l: e.logger, limit: e.payloadLimit}
+	if c, ok := connector.(driver.ConnectorLogger); ok {
+		c.SetLogger(e.logger)
+	}
+	return e
 }
 
 // Subscribe subscribes all registered topics and calls the provided consume function with the message.
+// It blocks until the subscription is stopped by Unsubscribe or Close, returning nil in that case.
 func (e *Bus) Subscribe() error {
+	return e.SubscribeWithOptions(driver.SubscribeOptions{})
+}
+
+// SubscribeWithOptions is Subscribe with options for the subscription, such as how many
+// messages are consumed at once.
+func (e *Bus) SubscribeWithOptions(opts driver.SubscribeOptions) error {
 	if len(e.Topics) < 1 {
 		return fmt.Errorf("unable to subscribe: %w", ErrNoConsumers)
 	}
 
+	e.subMu.Lock()
 	if e.cancelSub != nil {
+		e.subMu.Unlock()
 		return fmt.Errorf("unable to subscribe: subscription already open")
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	e.cancelSub = cancel
 
-	conn, err := e.connector.Connect()
+	conn, err := e.connector.Connect(ctx)
 	if err != nil {
+		e.subMu.Unlock()
+		cancel()
 		return err
 	}
 
-	return conn.Subscribe(ctx, e.Topics)
+	done := make(chan struct{})
+	e.cancelSub = cancel
+	e.subConn = conn
+	e.subDone = done
+	e.subMu.Unlock()
+
+	defer func() {
+		conn.Close()
+
+		e.subMu.Lock()
+		e.cancelSub = nil
+		e.subConn = nil
+		e.subDone = nil
+		e.subMu.Unlock()
+
+		cancel()
+		close(done)
+	}()
+
+	topics := make([]driver.Topic, len(e.Topics))
+	for i, t := range e.Topics {
+		t = e.handleErrors(e.consumeChain(e.dedupe.wrap(t)))
+		t = e.measure(t)
+		topics[i] = e.extractTrace(filterTenant(t, opts.Tenant))
+	}
+
+	if c, ok := conn.(driver.ConnSubscribeWithOptions); ok {
+		return c.SubscribeWithOptions(ctx, topics, opts)
+	}
+	return conn.Subscribe(ctx, topics)
+}
+
+// filterTenant wraps the topic's consumer so messages for tenants other than the
+// given one are skipped. Only drivers delivering a driver.Delivery carry the
+// tenant, anything else is passed through.
+func filterTenant(t driver.Topic, tenant string) driver.Topic {
+	if tenant == "" || t.Consumer == nil {
+		return t
+	}
+
+	consumer := t.Consumer
+	t.Consumer = func(ctx context.Context, msg driver.Message) error {
+		if d, ok := msg.(driver.Delivery); ok && d.Envelope.Tenant != tenant {
+			return nil
+		}
+		return consumer(ctx, msg)
+	}
+	return t
+}
+
+// Unsubscribe stops the open subscription, if there is one. The driver stops
+// accepting deliveries and Unsubscribe waits for the messages already being
+// consumed to finish. If ctx is done before then, the subscription's connection
+// is closed and whatever has not been acknowledged is left for the event bus to
+// redeliver, and ctx's error is returned.
+func (e *Bus) Unsubscribe(ctx context.Context) error {
+	e.subMu.Lock()
+	cancel, conn, done := e.cancelSub, e.subConn, e.subDone
+	e.subMu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		conn.Close()
+		return ctx.Err()
+	}
 }
 
 // RegisterConsumer register consume method
 // This method is not thread safe, DO NOT init twice in your code
 func (e *Bus) RegisterConsumer(topic driver.Topic) error {
+	if topic.Consumer == nil {
+		return fmt.Errorf("bus: topic %q has no consumer", topic.Name)
+	}
 	e.Topics = append(e.Topics, topic)
 	return nil
 }
 
 // Push pushes a message to a given topic and partition. Extra args are also passed through
-// that can be used by the driver if needed.
-func (e *Bus) Push(topic driver.Topic, tenant string, message driver.Message) error {
-	return e.PushContext(context.Background(), topic, tenant, message)
+// that can be used by the driver if needed. The tenant is carried in the message's
+// envelope, leave it empty for messages that aren't tenant specific.
+func (e *Bus) Push(topic driver.Topic, tenant string, message driver.Message, opts ...PushOption) error {
+	return e.PushContext(context.Background(), topic, tenant, message, opts...)
 }
 
 // PushContext pushes a message to the given topic and partition, in context of the given context.
 // The driver should implement a check if the context is done to cancel the push.
+// The options fill in the message's envelope, a message ID is generated if not given.
 func (e *Bus) PushContext(
 	ctx context.Context,
 	topic driver.Topic,
 	tenant string,
 	message driver.Message,
+	opts ...PushOption,
 ) error {
-	return e.push(ctx, topic, tenant, message)
+	if topic.Codec == nil {
+		topic.Codec = e.codec
+	}
+
+	env, err := NewEnvelope(topic, message, opts...)
+	if err != nil {
+		return err
+	}
+	if tenant != "" {
+		env.Tenant = tenant
+	}
+
+	return e.publishChain(e.push)(ctx, topic, env, message)
 }
 
-func (e *Bus) push(
-	ctx context.Context,
-	topic driver.Topic,
-	tenant string,
-	message driver.Message,
-) error {
-	// get connected
-	c, err := e.connector.Connect()
+func (e *Bus) push(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) error {
+	return e.send(ctx, topic, env, func(ctx context.Context, env Envelope) error {
+		return e.pushConn(ctx, topic, env, message)
+	})
+}
+
+// send pushes env with pushConn, trying again on another connection if it was a
+// bad one, and records how the push went.
+func (e *Bus) send(ctx context.Context, topic driver.Topic, env Envelope, pushConn func(ctx context.Context, env Envelope) error) error {
+	// last thing before the driver, so spans started by middleware are the parent
+	env.Headers = e.inject(ctx, env.Headers)
+
+	start := time.Now()
+	var err error
+	for i := 0; i < maxBadConnRetries; i++ {
+		err = pushConn(ctx, env)
+		if !errors.Is(err, driver.ErrBadConn) {
+			break
+		}
+	}
+
+	e.metrics.Observe(driver.TimingPublish, topic.Name, time.Since(start))
+	if err != nil {
+		e.metrics.Add(driver.MetricPublishFailed, topic.Name)
+		return err
+	}
+	e.metrics.Add(driver.MetricPublished, topic.Name)
+	return nil
+}
+
+// pushConn borrows a connection from the pool for a single push.
+func (e *Bus) pushConn(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) error {
+	c, err := e.pool.conn(ctx)
 	if err != nil {
 		return err
 	}
 
-	return c.Push(ctx, topic, message)
+	if pe, ok := c.(driver.ConnPushEnvelope); ok {
+		err = pe.PushEnvelope(ctx, topic, env, message)
+	} else {
+		err = c.Push(ctx, topic, message)
+	}
+	e.pool.release(c, err)
+	return err
+}
+
+// OnConnState registers f to be called whenever the driver's connection to the
+// event bus changes state, such as losing the connection and every attempt to
+// reconnect. Useful for alerting. Drivers which don't report their connection
+// state never call f.
+func (e *Bus) OnConnState(f func(driver.ConnEvent)) {
+	if n, ok := e.connector.(driver.ConnStateNotifier); ok {
+		n.NotifyState(f)
+	}
+}
+
+// SetCodec sets the codec used to encode messages on topics without a codec of
+// their own. The default is codec.JSON. Consumers decode by the content type
+// messages were pushed with, so the codec must also be registered with
+// codec.Register to be consumed.
+func (e *Bus) SetCodec(c driver.Codec) {
+	e.codec = c
+}
+
+// SetMaxPushConns sets the maximum number of connections held open for pushing,
+// the same as sql.DB.SetMaxOpenConns. Pushes beyond that wait for a connection to
+// be released. If n <= 0 there is no limit. The default is 10.
+func (e *Bus) SetMaxPushConns(n int) {
+	e.pool.setMaxOpen(n)
+}
+
+// Close unsubscribes, draining in-flight messages as Unsubscribe does, and then
+// closes the connections held for pushing, and the connector if it implements
+// io.Closer. Pushes in flight finish before their connection is closed.
+func (e *Bus) Close(ctx context.Context) error {
+	err := e.Unsubscribe(ctx)
+
+	if perr := e.pool.close(); perr != nil && err == nil {
+		err = perr
+	}
+
+	if c, ok := e.connector.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
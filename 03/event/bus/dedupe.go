@@ -0,0 +1,86 @@
+package bus
+
+import (
+	"context"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// DedupeStore records which messages have been consumed, so redeliveries of them
+// can be skipped. See package dedupe for stores on a cache and on SQL.
+type DedupeStore interface {
+	// Seen reports whether key has been marked, and the mark hasn't expired.
+	Seen(ctx context.Context, key string) (bool, error)
+	// Mark records key as consumed, for at least ttl.
+	Mark(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// dedupe is the idempotency layer set by SetDedupe.
+type dedupe struct {
+	store  DedupeStore
+	ttl    time.Duration
+	logger Logger
+}
+
+// SetDedupe makes consumers idempotent. Delivery is at least once, so consumers
+// can be given the same message more than once; with a store set, the message ID
+// is marked in it once a consumer succeeds, and messages already marked are
+// acknowledged without being consumed again. The ttl is the dedupe window, how
+// long after a message is consumed its redeliveries are still skipped.
+//
+// Messages are marked per topic, keyed "<topic>:<message id>". Services sharing a
+// store must use a prefix or table of their own, or they skip each other's
+// messages. Two copies of a message consumed at the same moment can both get
+// through, so it narrows the window for duplicates rather than closing it.
+//
+// It must be set before Subscribe, and only applies to drivers delivering a
+// driver.Delivery, as nothing else carries a message ID. A nil store turns it off.
+func (e *Bus) SetDedupe(store DedupeStore, ttl time.Duration) {
+	if store == nil {
+		e.dedupe = nil
+		return
+	}
+	e.dedupe = &dedupe{store: store, ttl: ttl, logger: e.logger}
+}
+
+// wrap wraps the topic's consumer so messages marked in the store are skipped,
+// and marks them once consumed.
+func (d *dedupe) wrap(t driver.Topic) driver.Topic {
+	if d == nil || t.Consumer == nil {
+		return t
+	}
+
+	consumer := t.Consumer
+	t.Consumer = func(ctx context.Context, msg driver.Message) error {
+		dl, ok := msg.(driver.Delivery)
+		if !ok || dl.Envelope.ID == "" {
+			return consumer(ctx, msg)
+		}
+
+		key := t.Name + ":" + dl.Envelope.ID
+		seen, err := d.store.Seen(ctx, key)
+		if err != nil {
+			// failing lets the driver retry it, rather than risk consuming it twice
+			return err
+		}
+		if seen {
+			return nil
+		}
+
+		if err := consumer(ctx, msg); err != nil {
+			return err
+		}
+
+		// it was consumed, failing it now would only consume it again
+		if err := d.store.Mark(ctx, key, d.ttl); err != nil {
+			d.logger.Error("bus unable to mark message as consumed",
+				"topic", t.Name,
+				"message_id", dl.Envelope.ID,
+				"error", err,
+			)
+		}
+		return nil
+	}
+	return t
+}
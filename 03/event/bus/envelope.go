@@ -0,0 +1,152 @@
+package bus
+
+import (
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// Envelope is the metadata carried alongside a message, see driver.Envelope.
+type Envelope = driver.Envelope
+
+// PushOption sets part of the envelope a message is pushed with.
+type PushOption func(*Envelope)
+
+// WithMessageID sets the message ID, rather than have one generated.
+func WithMessageID(id string) PushOption {
+	return func(e *Envelope) {
+		e.ID = id
+	}
+}
+
+// WithCorrelationID sets the correlation ID. It defaults to the message ID.
+func WithCorrelationID(id string) PushOption {
+	return func(e *Envelope) {
+		e.CorrelationID = id
+	}
+}
+
+// WithCausationID sets the ID of the message that caused this one.
+func WithCausationID(id string) PushOption {
+	return func(e *Envelope) {
+		e.CausationID = id
+	}
+}
+
+// CausedBy marks the message as caused by the consumed message with the given
+// envelope, carrying its correlation ID on.
+func CausedBy(cause Envelope) PushOption {
+	return func(e *Envelope) {
+		e.CausationID = cause.ID
+		e.CorrelationID = cause.CorrelationID
+		if e.CorrelationID == "" {
+			e.CorrelationID = cause.ID
+		}
+	}
+}
+
+// WithRoutingKey sets the routing key the message is pushed with. It must match
+// the topic's pattern, and is required when the topic name has wildcards, e.g.
+// "movie.release.drama" for the "movie.release.*" topic.
+func WithRoutingKey(key string) PushOption {
+	return func(e *Envelope) {
+		e.RoutingKey = key
+	}
+}
+
+// WithTenant sets the tenant the message belongs to.
+func WithTenant(tenant string) PushOption {
+	return func(e *Envelope) {
+		e.Tenant = tenant
+	}
+}
+
+// WithTimestamp sets when the message was created, rather than when it is pushed.
+func WithTimestamp(t time.Time) PushOption {
+	return func(e *Envelope) {
+		e.Timestamp = t
+	}
+}
+
+// WithHeader sets a header on the message.
+func WithHeader(key, value string) PushOption {
+	return func(e *Envelope) {
+		if e.Headers == nil {
+			e.Headers = make(map[string]string)
+		}
+		e.Headers[key] = value
+	}
+}
+
+// NewEnvelope checks the message can be pushed onto the topic, and builds the
+// envelope it is pushed with, the same as PushContext does. It is for pushing
+// messages some other way, such as through an outbox.
+func NewEnvelope(topic driver.Topic, message driver.Message, opts ...PushOption) (Envelope, error) {
+	// assert it has the right type, typed topics get this checked at compile
+	// time but a plain driver.Topic can be pushed anything
+	messageType := reflect.TypeOf(message)
+	topicType := reflect.TypeOf(topic.Type)
+
+	if messageType != topicType {
+		return Envelope{}, fmt.Errorf("message type: %s does not match topic type: %s", messageType, topicType)
+	}
+
+	env, err := newEnvelope(opts)
+	if err != nil {
+		return env, err
+	}
+
+	// the topic name is what subscribers bind with, so it may be a pattern, but
+	// messages have to go out with a concrete key that the pattern matches
+	if env.RoutingKey == "" {
+		env.RoutingKey = topic.Name
+	}
+	if driver.IsPattern(env.RoutingKey) {
+		return env, fmt.Errorf("topic %q has wildcards, push with a concrete routing key using WithRoutingKey", topic.Name)
+	}
+	if !driver.Match(topic.Name, env.RoutingKey) {
+		return env, fmt.Errorf("routing key %q does not match topic %q", env.RoutingKey, topic.Name)
+	}
+
+	return env, nil
+}
+
+// newEnvelope builds the envelope for a push, filling in whatever the options
+// left out.
+func newEnvelope(opts []PushOption) (Envelope, error) {
+	var env Envelope
+	for _, opt := range opts {
+		opt(&env)
+	}
+
+	if env.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return env, err
+		}
+		env.ID = id
+	}
+	if env.CorrelationID == "" {
+		env.CorrelationID = env.ID
+	}
+	if env.Timestamp.IsZero() {
+		env.Timestamp = time.Now()
+	}
+
+	return env, nil
+}
+
+// newID returns a random (version 4) UUID.
+func newID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("unable to generate message id: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
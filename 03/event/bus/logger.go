@@ -0,0 +1,92 @@
+package bus
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// Logger is what the bus and its driver log to, see driver.Logger. A
+// *slog.Logger can be used as is.
+type Logger = driver.Logger
+
+// Option configures a bus as it is opened.
+type Option func(*Bus)
+
+// WithLogger logs to l rather than the standard library's log package. Drivers
+// implementing driver.ConnectorLogger log to it too.
+func WithLogger(l Logger) Option {
+	return func(e *Bus) {
+		e.logger = l
+	}
+}
+
+// WithPayloadLimit sets how much of a message's body is logged, such as when a
+// consumer fails on it. The default, 0, logs none of it, as bodies can hold
+// personal data; n > 0 logs up to n bytes, and n < 0 all of it.
+func WithPayloadLimit(n int) Option {
+	return func(e *Bus) {
+		e.payloadLimit = n
+	}
+}
+
+// Logger returns the logger the bus logs to, for packages built on the bus to
+// log alongside it.
+func (e *Bus) Logger() Logger {
+	return e.logger
+}
+
+// payloads is a Logger redacting or truncating the payloads logged to it, which
+// are the []byte values.
+type payloads struct {
+	l     Logger
+	limit int
+}
+
+func (p payloads) Debug(msg string, args ...any) {
+	p.l.Debug(msg, p.redact(args)...)
+}
+
+func (p payloads) Info(msg string, args ...any) {
+	p.l.Info(msg, p.redact(args)...)
+}
+
+func (p payloads) Warn(msg string, args ...any) {
+	p.l.Warn(msg, p.redact(args)...)
+}
+
+func (p payloads) Error(msg string, args ...any) {
+	p.l.Error(msg, p.redact(args)...)
+}
+
+func (p payloads) redact(args []any) []any {
+	var ret []any
+	for i, arg := range args {
+		b, ok := arg.([]byte)
+		if !ok {
+			continue
+		}
+		if ret == nil {
+			// leave the caller's args alone
+			ret = append([]any(nil), args...)
+		}
+
+		switch {
+		case p.limit < 0:
+			ret[i] = string(b)
+		case p.limit == 0:
+			ret[i] = fmt.Sprintf("[redacted %d bytes]", len(b))
+		case len(b) > p.limit:
+			// don't leave half a character on the end
+			ret[i] = fmt.Sprintf("%s... [%d bytes]", strings.ToValidUTF8(string(b[:p.limit]), ""), len(b))
+		default:
+			ret[i] = string(b)
+		}
+	}
+
+	if ret == nil {
+		return args
+	}
+	return ret
+}
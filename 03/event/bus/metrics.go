@@ -0,0 +1,68 @@
+package bus
+
+import (
+	"context"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// Metrics receives the counts and timings of the bus and its driver, labelled
+// with the driver and the topic. See package prombus for Prometheus.
+type Metrics interface {
+	Add(m driver.Metric, driverName, topic string)
+	Observe(t driver.Timing, driverName, topic string, d time.Duration)
+}
+
+// SetMetrics sets where the bus and its driver report to. Pushes and consumers
+// are measured by the bus, whatever the driver; what happens to messages after a
+// consumer fails is only counted by drivers implementing
+// driver.ConnectorMetrics. The driver label is the name the bus was opened with,
+// which is empty for OpenConnector. It must be set before the bus is used.
+func (e *Bus) SetMetrics(m Metrics) {
+	if m == nil {
+		e.metrics = driver.NopMetrics{}
+	} else {
+		e.metrics = labelled{m: m, driverName: e.driverName}
+	}
+
+	if c, ok := e.connector.(driver.ConnectorMetrics); ok {
+		c.SetMetrics(e.metrics)
+	}
+}
+
+// labelled is Metrics as drivers see it, with the driver label filled in.
+type labelled struct {
+	m          Metrics
+	driverName string
+}
+
+func (l labelled) Add(m driver.Metric, topic string) {
+	l.m.Add(m, l.driverName, topic)
+}
+
+func (l labelled) Observe(t driver.Timing, topic string, d time.Duration) {
+	l.m.Observe(t, l.driverName, topic, d)
+}
+
+// measure wraps the topic's consumer to count what it consumes and time it.
+func (e *Bus) measure(t driver.Topic) driver.Topic {
+	if t.Consumer == nil {
+		return t
+	}
+
+	m := e.metrics
+	consumer := t.Consumer
+	t.Consumer = func(ctx context.Context, msg driver.Message) error {
+		start := time.Now()
+		err := consumer(ctx, msg)
+		m.Observe(driver.TimingHandler, t.Name, time.Since(start))
+		if err != nil {
+			m.Add(driver.MetricFailed, t.Name)
+			return err
+		}
+		m.Add(driver.MetricConsumed, t.Name)
+		return nil
+	}
+	return t
+}
@@ -0,0 +1,164 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// PushFunc pushes a message, with the envelope built for it, onto the topic.
+type PushFunc func(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) error
+
+// PublishMiddleware wraps every push made through the bus, once the message has
+// been checked and given its envelope. It can change the envelope, or stop the
+// push by returning an error rather than calling next.
+type PublishMiddleware func(next PushFunc) PushFunc
+
+// ConsumeMiddleware wraps the consumer of each topic, whatever the driver. It is
+// called once per topic when subscribing, and the consumer it returns for every
+// message on the topic.
+type ConsumeMiddleware func(topic driver.Topic, next driver.Consume) driver.Consume
+
+// UsePublish adds middleware to every push. The first added is outermost, seeing
+// the push first and its result last.
+func (e *Bus) UsePublish(mw ...PublishMiddleware) {
+	e.publishMW = append(e.publishMW, mw...)
+}
+
+// UseConsume adds middleware to every consumer, the same as UsePublish. It must
+// be called before Subscribe.
+func (e *Bus) UseConsume(mw ...ConsumeMiddleware) {
+	e.consumeMW = append(e.consumeMW, mw...)
+}
+
+// publishChain returns push wrapped in the publish middleware.
+func (e *Bus) publishChain(push PushFunc) PushFunc {
+	for i := len(e.publishMW) - 1; i >= 0; i-- {
+		push = e.publishMW[i](push)
+	}
+	return push
+}
+
+// consumeChain wraps the topic's consumer in the consume middleware.
+func (e *Bus) consumeChain(t driver.Topic) driver.Topic {
+	if t.Consumer == nil {
+		return t
+	}
+	for i := len(e.consumeMW) - 1; i >= 0; i-- {
+		t.Consumer = e.consumeMW[i](t, t.Consumer)
+	}
+	return t
+}
+
+// envelopeOf returns the envelope the driver delivered msg with, if it did.
+func envelopeOf(topic driver.Topic, msg driver.Message) Envelope {
+	if d, ok := msg.(driver.Delivery); ok {
+		return d.Envelope
+	}
+	return Envelope{Topic: topic.Name}
+}
+
+// LogPublish logs every push to l, with how long it took and whether it failed.
+// Pass the bus' Logger to log alongside it.
+func LogPublish(l Logger) PublishMiddleware {
+	return func(next PushFunc) PushFunc {
+		return func(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) error {
+			start := time.Now()
+			err := next(ctx, topic, env, message)
+			if err != nil {
+				l.Error("bus push failed",
+					"topic", topic.Name,
+					"routing_key", env.RoutingKey,
+					"message_id", env.ID,
+					"duration", time.Since(start),
+					"error", err,
+				)
+				return err
+			}
+			l.Info("bus pushed message",
+				"topic", topic.Name,
+				"routing_key", env.RoutingKey,
+				"message_id", env.ID,
+				"duration", time.Since(start),
+			)
+			return nil
+		}
+	}
+}
+
+// LogConsume logs every message consumed to l, with how long it took and whether
+// it failed.
+func LogConsume(l Logger) ConsumeMiddleware {
+	return func(topic driver.Topic, next driver.Consume) driver.Consume {
+		return func(ctx context.Context, msg driver.Message) error {
+			env := envelopeOf(topic, msg)
+			start := time.Now()
+			err := next(ctx, msg)
+			if err != nil {
+				l.Error("bus consumer failed",
+					"topic", topic.Name,
+					"routing_key", env.RoutingKey,
+					"message_id", env.ID,
+					"attempt", env.Attempt,
+					"duration", time.Since(start),
+					"error", err,
+				)
+				return err
+			}
+			l.Info("bus consumed message",
+				"topic", topic.Name,
+				"routing_key", env.RoutingKey,
+				"message_id", env.ID,
+				"attempt", env.Attempt,
+				"duration", time.Since(start),
+			)
+			return nil
+		}
+	}
+}
+
+// PublishTimeout gives every push d to finish, unless the caller's context has
+// a deadline already.
+func PublishTimeout(d time.Duration) PublishMiddleware {
+	return func(next PushFunc) PushFunc {
+		return func(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) error {
+			if _, ok := ctx.Deadline(); !ok {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d)
+				defer cancel()
+			}
+			return next(ctx, topic, env, message)
+		}
+	}
+}
+
+// Validator is implemented by messages which can check themselves.
+type Validator interface {
+	Validate() error
+}
+
+// Validate refuses to push messages implementing Validator that fail to
+// validate.
+func Validate() PublishMiddleware {
+	return func(next PushFunc) PushFunc {
+		return func(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) error {
+			if v, ok := message.(Validator); ok {
+				if err := v.Validate(); err != nil {
+					return fmt.Errorf("invalid message for %q: %w", topic.Name, err)
+				}
+			}
+			return next(ctx, topic, env, message)
+		}
+	}
+}
+
+// Recover turns a panicking consumer into one failing with a *PanicError. The bus
+// recovers panics anyway, this is for middleware added before it to see them as
+// failures, such as LogConsume.
+func Recover() ConsumeMiddleware {
+	return func(topic driver.Topic, next driver.Consume) driver.Consume {
+		return recoverPanics(next)
+	}
+}
@@ -1,16 +1,12 @@
 package bus
 
 import (
-	"encoding/json"
+	"context"
 
 	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
 )
 
-var MovieRelease = driver.Topic{
-	Name:     "movie.release.*",
-	Type:     MovieReleaseMessage{},
-	Exchange: "movie",
-}
+var MovieRelease = NewTopic[MovieReleaseMessage]("movie.release.*", "movie")
 
 type MovieReleaseMessage struct {
 	ID      int    `json:"id"`
@@ -20,6 +16,9 @@ type MovieReleaseMessage struct {
 	Rating  int    `json:"rating"`
 }
 
+// RegisterMovieReleaseConsumer registers a movie release consumer.
+//
+// Deprecated: use Handle with MovieRelease.
 func (e *Bus) RegisterMovieReleaseConsumer(
 	f func(mrm MovieReleaseMessage) error,
 ) error {
@@ -27,26 +26,11 @@ func (e *Bus) RegisterMovieReleaseConsumer(
 	return e.RegisterConsumer(topic)
 }
 
-// CreateMovieReleaseTopic creates a print job topic
+// CreateMovieReleaseTopic creates a movie release topic
+//
+// Deprecated: use Handle with MovieRelease.
 func CreateMovieReleaseTopic(f func(MovieReleaseMessage) error) driver.Topic {
-	b := func(msg driver.Message) error {
-		pj := MovieReleaseMessage{}
-		// msg is an any interface, so go to bytes first
-		switch s := msg.(type) {
-		case []byte:
-			// then we can unmarshal
-			err := json.Unmarshal([]byte(s), &pj)
-			if err != nil {
-				return err
-			}
-		case MovieReleaseMessage:
-			pj = s
-		}
-
-		return f(pj)
-	}
-
-	topic := MovieRelease
-	topic.Consumer = b
-	return topic
+	return MovieRelease.withConsumer(func(_ context.Context, _ Envelope, mrm MovieReleaseMessage) error {
+		return f(mrm)
+	})
 }
@@ -0,0 +1,126 @@
+// Package otelbus connects the bus to OpenTelemetry: a propagator carrying the
+// trace across the bus in message headers, and middleware starting spans for
+// pushing and consuming.
+//
+//	eb.SetPropagator(otelbus.Propagator(nil))
+//	eb.UsePublish(otelbus.PublishSpans(nil))
+//	eb.UseConsume(otelbus.ConsumeSpans(nil))
+package otelbus
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+const instrumentationName = "github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus/otelbus"
+
+// propagator adapts a TextMapPropagator to bus.Propagator.
+type propagator struct {
+	p propagation.TextMapPropagator
+}
+
+// Propagator returns p as a bus.Propagator. A nil p uses the global propagator,
+// see otel.SetTextMapPropagator, which needs to include propagation.TraceContext
+// for W3C headers.
+func Propagator(p propagation.TextMapPropagator) bus.Propagator {
+	return propagator{p}
+}
+
+func (p propagator) textMap() propagation.TextMapPropagator {
+	if p.p == nil {
+		return otel.GetTextMapPropagator()
+	}
+	return p.p
+}
+
+func (p propagator) Inject(ctx context.Context, headers map[string]string) {
+	p.textMap().Inject(ctx, propagation.MapCarrier(headers))
+}
+
+func (p propagator) Extract(ctx context.Context, headers map[string]string) context.Context {
+	return p.textMap().Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// tracer returns a tracer from tp, or the global provider if it is nil.
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(instrumentationName)
+}
+
+// PublishSpans starts a producer span for every push, as the parent of the spans
+// its consumers start. A nil tp uses the global provider.
+func PublishSpans(tp trace.TracerProvider) bus.PublishMiddleware {
+	t := tracer(tp)
+
+	return func(next bus.PushFunc) bus.PushFunc {
+		return func(ctx context.Context, topic driver.Topic, env bus.Envelope, message driver.Message) error {
+			ctx, span := t.Start(ctx, env.RoutingKey+" send",
+				trace.WithSpanKind(trace.SpanKindProducer),
+				trace.WithAttributes(attributes(topic, env)...),
+			)
+			defer span.End()
+
+			err := next(ctx, topic, env, message)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return err
+		}
+	}
+}
+
+// ConsumeSpans starts a consumer span for every message consumed, a child of the
+// span it was pushed in when the propagator carried it. A nil tp uses the global
+// provider.
+func ConsumeSpans(tp trace.TracerProvider) bus.ConsumeMiddleware {
+	t := tracer(tp)
+
+	return func(topic driver.Topic, next driver.Consume) driver.Consume {
+		return func(ctx context.Context, msg driver.Message) error {
+			env := bus.Envelope{Topic: topic.Name}
+			if d, ok := msg.(driver.Delivery); ok {
+				env = d.Envelope
+			}
+
+			ctx, span := t.Start(ctx, topic.Name+" process",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(attributes(topic, env)...),
+				trace.WithAttributes(attribute.Int("messaging.attempt", env.Attempt)),
+			)
+			defer span.End()
+
+			err := next(ctx, msg)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return err
+		}
+	}
+}
+
+// attributes describes the message, after the OpenTelemetry messaging
+// conventions.
+func attributes(topic driver.Topic, env bus.Envelope) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.destination", topic.Exchange),
+		attribute.String("messaging.routing_key", env.RoutingKey),
+		attribute.String("messaging.message_id", env.ID),
+		attribute.String("messaging.conversation_id", env.CorrelationID),
+	}
+	if env.Tenant != "" {
+		attrs = append(attrs, attribute.String("bus.tenant", env.Tenant))
+	}
+	return attrs
+}
@@ -0,0 +1,201 @@
+// Package outbox pushes messages atomically with database writes, using the
+// transactional outbox pattern.
+//
+// Rather than pushing to the event bus, which can't take part in a database
+// transaction, PushTx writes the message to an outbox table in the caller's
+// transaction. It is only there if the transaction commits, and a Relay pushes
+// it onto the bus from there, in the order written, see Relay. A message is marked sent once the bus
+// has it, so a crash in between means pushing it again: delivery is at least
+// once, and consumers should be idempotent.
+//
+//	tx, _ := db.BeginTx(ctx, nil)
+//	tx.ExecContext(ctx, "INSERT INTO movies ...")
+//	outbox.PublishTx(ctx, ob, tx, bus.MovieRelease, msg, bus.WithRoutingKey("movie.release.drama"))
+//	tx.Commit()
+//
+//	go ob.Relay(ctx, eb)
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/internal/sqldialect"
+)
+
+// Dialect is the flavour of SQL spoken by the database.
+type Dialect = sqldialect.Dialect
+
+const (
+	Postgres = sqldialect.Postgres
+	SQLite   = sqldialect.SQLite
+)
+
+// DefaultTable is the outbox table used when New is given no table name.
+const DefaultTable = "bus_outbox"
+
+// Outbox writes messages to an outbox table for a Relay to push.
+type Outbox struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+	codec   driver.Codec
+
+	propagator bus.Propagator
+
+	pollInterval time.Duration
+	batchSize    int
+	retention    time.Duration
+}
+
+// New returns an outbox on the table in db, creating the table if it doesn't
+// exist. An empty table name uses DefaultTable.
+func New(db *sql.DB, dialect Dialect, table string) (*Outbox, error) {
+	if table == "" {
+		table = DefaultTable
+	}
+	// it goes straight into the SQL
+	if !sqldialect.ValidIdentifier(table) {
+		return nil, fmt.Errorf("outbox: invalid table %q", table)
+	}
+
+	o := &Outbox{
+		db:           db,
+		dialect:      dialect,
+		table:        table,
+		codec:        codec.JSON,
+		propagator:   bus.W3C{},
+		pollInterval: time.Second,
+		batchSize:    100,
+		retention:    24 * time.Hour,
+	}
+	if err := o.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// SetCodec sets the codec used to encode messages on topics without a codec of
+// their own. It should match the bus' codec, the default is codec.JSON.
+func (o *Outbox) SetCodec(c driver.Codec) {
+	o.codec = c
+}
+
+// SetPropagator sets how the trace PushTx is called in is carried in the message's
+// headers. It should match the bus' propagator, the default is bus.W3C. A nil
+// propagator carries nothing.
+func (o *Outbox) SetPropagator(p bus.Propagator) {
+	o.propagator = p
+}
+
+// SetPollInterval sets how long the relay waits before looking for messages again
+// when there were none. The default is a second.
+func (o *Outbox) SetPollInterval(d time.Duration) {
+	o.pollInterval = d
+}
+
+// SetRetention sets how long sent messages are kept in the table before being
+// deleted. The default is a day.
+func (o *Outbox) SetRetention(d time.Duration) {
+	o.retention = d
+}
+
+// PublishTx is PushTx for typed topics.
+func PublishTx[T any](ctx context.Context, o *Outbox, tx *sql.Tx, topic bus.Topic[T], msg T, opts ...bus.PushOption) error {
+	return o.PushTx(ctx, tx, topic.Topic, msg, opts...)
+}
+
+// PushTx writes the message to the outbox in tx, to be pushed onto the topic by
+// the relay once tx commits. It is checked and given its envelope now, the same
+// as it would be by bus.PushContext, so the message ID is known up front, and
+// carries the trace in ctx, as the relay pushes it without.
+func (o *Outbox) PushTx(ctx context.Context, tx *sql.Tx, topic driver.Topic, msg driver.Message, opts ...bus.PushOption) error {
+	env, err := bus.NewEnvelope(topic, msg, opts...)
+	if err != nil {
+		return err
+	}
+	env.Headers = bus.InjectTrace(ctx, o.propagator, env.Headers)
+
+	c := topic.Codec
+	if c == nil {
+		c = o.codec
+	}
+	body, err := c.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	headers := ""
+	if len(env.Headers) > 0 {
+		h, err := json.Marshal(env.Headers)
+		if err != nil {
+			return err
+		}
+		headers = string(h)
+	}
+
+	_, err = tx.ExecContext(ctx, o.dialect.Rebind(`INSERT INTO `+o.table+` (topic, exchange, routing_key,
+message_id, correlation_id, causation_id, tenant, headers, content_type, body, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		topic.Name,
+		topic.Exchange,
+		env.RoutingKey,
+		env.ID,
+		env.CorrelationID,
+		env.CausationID,
+		env.Tenant,
+		headers,
+		c.ContentType(),
+		body,
+		env.Timestamp.UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to write to outbox: %w", err)
+	}
+	return nil
+}
+
+// migrate creates the table if it doesn't exist. Times are stored as unix
+// milliseconds, so they compare the same on every database.
+func (o *Outbox) migrate(ctx context.Context) error {
+	id, blob := o.dialect.SerialPrimaryKey(), o.dialect.Blob()
+
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + o.table + ` (
+	id             ` + id + `,
+	topic          TEXT NOT NULL,
+	exchange       TEXT NOT NULL,
+	routing_key    TEXT NOT NULL,
+	message_id     TEXT NOT NULL,
+	correlation_id TEXT NOT NULL,
+	causation_id   TEXT NOT NULL,
+	tenant         TEXT NOT NULL,
+	headers        TEXT NOT NULL,
+	content_type   TEXT NOT NULL,
+	body           ` + blob + `,
+	created_at     BIGINT NOT NULL,
+	sent_at        BIGINT
+)`,
+		`CREATE INDEX IF NOT EXISTS ` + o.table + `_unsent ON ` + o.table + ` (sent_at, id)`,
+		// the lease relays take turns with, on its one row
+		`CREATE TABLE IF NOT EXISTS ` + o.table + `_relay (
+	id           INTEGER PRIMARY KEY,
+	holder       TEXT NOT NULL,
+	locked_until BIGINT NOT NULL
+)`,
+		`INSERT INTO ` + o.table + `_relay (id, holder, locked_until) VALUES (1, '', 0) ON CONFLICT DO NOTHING`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err := o.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("unable to create outbox table: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	_ "github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/memory"
+)
+
+type message struct {
+	N int
+}
+
+var (
+	movieRelease = bus.NewTopic[message]("movie.release", "movie")
+	// ready is pushed until it comes back, to know the subscription is open
+	ready = bus.NewTopic[message]("movie.ready", "movie")
+)
+
+// newOutbox returns an outbox on a SQLite database of the test's own, and the
+// database.
+func newOutbox(t *testing.T) (*Outbox, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "outbox.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	o, err := New(db, SQLite, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.SetPollInterval(10 * time.Millisecond)
+	return o, db
+}
+
+// consumer collects the messages pushed onto movieRelease.
+type consumer struct {
+	mu  sync.Mutex
+	got []int
+}
+
+func (c *consumer) received() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.got...)
+}
+
+// openBus opens a bus on a memory broker of the test's own, subscribed to
+// movieRelease, returning once the subscription is open.
+func openBus(t *testing.T) (*bus.Bus, *consumer) {
+	t.Helper()
+
+	name := strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-"))
+	b, err := bus.Open("memory", "memory://"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &consumer{}
+	err = bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.got = append(c.got, msg.N)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readyc := make(chan struct{}, 1)
+	err = bus.Handle(b, ready, func(ctx context.Context, msg message) error {
+		select {
+		case readyc <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		// one worker, so messages are consumed in the order pushed
+		errc <- b.SubscribeWithOptions(driver.SubscribeOptions{Workers: 1})
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("subscribe: %v", err)
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := bus.Publish(context.Background(), b, ready, message{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-readyc:
+			return b, c
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the subscription")
+		}
+	}
+}
+
+// write writes messages to the outbox in a transaction, committing it or not.
+func write(t *testing.T, o *Outbox, db *sql.DB, commit bool, ns ...int) {
+	t.Helper()
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range ns {
+		if err := PublishTx(ctx, o, tx, movieRelease, message{N: n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if commit {
+		err = tx.Commit()
+	} else {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// relay runs relays on the outbox until the test finishes.
+func relay(t *testing.T, o *Outbox, b *bus.Bus, relays int) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < relays; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := o.Relay(ctx, b); err != nil {
+				t.Errorf("relay: %v", err)
+			}
+		}()
+	}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+// waitFor fails the test if c hasn't received n messages in time.
+func waitFor(t *testing.T, c *consumer, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.received()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d messages, got %v", n, c.received())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Only committed messages are pushed, each once, in order, and marked sent, even
+// with relays running side by side.
+func TestRelay(t *testing.T) {
+	o, db := newOutbox(t)
+	b, c := openBus(t)
+
+	write(t, o, db, true, 1, 2)
+	write(t, o, db, false, 3)
+	write(t, o, db, true, 4, 5)
+	relay(t, o, b, 3)
+
+	waitFor(t, c, 4)
+	write(t, o, db, true, 6)
+	waitFor(t, c, 5)
+	// anything pushed twice would turn up by now
+	time.Sleep(100 * time.Millisecond)
+
+	got := c.received()
+	want := []int{1, 2, 4, 5, 6}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	var rows, unsent int
+	err := db.QueryRow(`SELECT COUNT(*), COUNT(*) - COUNT(sent_at) FROM bus_outbox`).Scan(&rows, &unsent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 5 || unsent != 0 {
+		t.Fatalf("%d rows with %d unsent, want 5 with 0", rows, unsent)
+	}
+}
+
+// A relay waits for the lease another relay holds to run out before pushing.
+func TestRelayLease(t *testing.T) {
+	o, db := newOutbox(t)
+	b, c := openBus(t)
+
+	until := time.Now().Add(300 * time.Millisecond)
+	if _, err := db.Exec(`UPDATE bus_outbox_relay SET holder = 'gone', locked_until = ?`, until.UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, o, db, true, 1)
+	relay(t, o, b, 1)
+
+	waitFor(t, c, 1)
+	if time.Now().Before(until) {
+		t.Fatal("pushed while another relay had the lease")
+	}
+}
@@ -0,0 +1,238 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// cleanupInterval is how often the relay deletes sent messages older than the
+// retention.
+const cleanupInterval = 10 * time.Minute
+
+// relayLease is how long a relay has the outbox to itself, renewed with every
+// batch. If a relay goes away without handing it back, another takes over once
+// it runs out.
+const relayLease = 30 * time.Second
+
+// row is a message in the outbox, already encoded.
+type row struct {
+	id          int64
+	topic       string
+	exchange    string
+	routingKey  string
+	messageID   string
+	correlation string
+	causation   string
+	tenant      string
+	headers     string
+	contentType string
+	body        []byte
+	createdAt   int64
+}
+
+// Relay pushes messages from the outbox onto b until ctx is done. They are pushed
+// in the order of their IDs, and if a push fails the relay stops there and tries
+// again from that message, so a message is never skipped.
+//
+// IDs are handed out as messages are written though, not as their transactions
+// commit. On Postgres a message written after another can be committed, and
+// pushed, first if the transactions overlap; only messages written in the same
+// transaction are sure to be pushed in order. SQLite has a single writer, so its
+// IDs are in the order transactions commit.
+//
+// Running a relay in every instance of a service is fine, they take turns with a
+// lease on the outbox so only one pushes at a time, without holding any locks
+// while it does. A relay stops pushing once its lease is up, and if it went away
+// anything it hadn't marked sent is pushed again by the next, which at least
+// once delivery allows for anyway.
+func (o *Outbox) Relay(ctx context.Context, b *bus.Bus) error {
+	holder, err := newHolder()
+	if err != nil {
+		return err
+	}
+	defer o.release(b, holder)
+
+	lastCleanup := time.Time{}
+
+	for {
+		n, err := o.relay(ctx, b, holder)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			b.Logger().Error("outbox unable to relay messages", "table", o.table, "error", err)
+		}
+
+		if time.Since(lastCleanup) > cleanupInterval {
+			lastCleanup = time.Now()
+			if err := o.cleanup(ctx); err != nil {
+				b.Logger().Error("outbox unable to delete sent messages", "table", o.table, "error", err)
+			}
+		}
+
+		// a full batch means there is probably more waiting
+		if err == nil && n == o.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(o.pollInterval):
+		}
+	}
+}
+
+// relay pushes a batch of unsent messages, if no other relay has the outbox,
+// returning how many were sent.
+func (o *Outbox) relay(ctx context.Context, b *bus.Bus, holder string) (int, error) {
+	until, ok, err := o.lease(ctx, holder)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	batch, err := o.unsent(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// another relay may have the outbox once the lease is up
+	pushCtx, cancel := context.WithDeadline(ctx, until)
+	defer cancel()
+
+	markSent := o.dialect.Rebind(`UPDATE ` + o.table + ` SET sent_at = ? WHERE id = ?`)
+	for i, r := range batch {
+		if err := o.push(pushCtx, b, r); err != nil {
+			return i, fmt.Errorf("unable to push message %s: %w", r.messageID, err)
+		}
+		// if this fails the message is pushed again next time
+		if _, err := o.db.ExecContext(ctx, markSent, time.Now().UnixMilli(), r.id); err != nil {
+			return i, err
+		}
+	}
+	return len(batch), nil
+}
+
+// unsent returns the next batch of messages to push.
+func (o *Outbox) unsent(ctx context.Context) ([]row, error) {
+	rows, err := o.db.QueryContext(ctx, o.dialect.Rebind(`SELECT id, topic, exchange, routing_key, message_id,
+correlation_id, causation_id, tenant, headers, content_type, body, created_at
+FROM `+o.table+` WHERE sent_at IS NULL ORDER BY id LIMIT ?`), o.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []row
+	for rows.Next() {
+		var r row
+		err := rows.Scan(
+			&r.id,
+			&r.topic,
+			&r.exchange,
+			&r.routingKey,
+			&r.messageID,
+			&r.correlation,
+			&r.causation,
+			&r.tenant,
+			&r.headers,
+			&r.contentType,
+			&r.body,
+			&r.createdAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, r)
+	}
+	return batch, rows.Err()
+}
+
+// lease takes the outbox for the holder, or renews it if the holder has it,
+// returning when it runs out. It is false while another relay has it.
+func (o *Outbox) lease(ctx context.Context, holder string) (time.Time, bool, error) {
+	now := time.Now()
+	until := now.Add(relayLease)
+
+	res, err := o.db.ExecContext(ctx, o.dialect.Rebind(`UPDATE `+o.table+`_relay SET holder = ?, locked_until = ?
+WHERE id = 1 AND (holder = ? OR locked_until <= ?)`),
+		holder,
+		until.UnixMilli(),
+		holder,
+		now.UnixMilli(),
+	)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("unable to lease outbox: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("unable to lease outbox: %w", err)
+	}
+	return until, n == 1, nil
+}
+
+// release hands the lease back, so another relay can take over straight away.
+func (o *Outbox) release(b *bus.Bus, holder string) {
+	_, err := o.db.ExecContext(context.Background(),
+		o.dialect.Rebind(`UPDATE `+o.table+`_relay SET locked_until = 0 WHERE id = 1 AND holder = ?`),
+		holder,
+	)
+	if err != nil {
+		b.Logger().Warn("outbox unable to release lease", "table", o.table, "error", err)
+	}
+}
+
+// newHolder returns a random name for a relay to hold the lease by.
+func newHolder() (string, error) {
+	var h [8]byte
+	if _, err := rand.Read(h[:]); err != nil {
+		return "", fmt.Errorf("unable to generate relay name: %w", err)
+	}
+	return hex.EncodeToString(h[:]), nil
+}
+
+// push pushes an outbox row onto the bus, with the envelope it was written with.
+func (o *Outbox) push(ctx context.Context, b *bus.Bus, r row) error {
+	topic := driver.Topic{
+		Name:     r.topic,
+		Exchange: r.exchange,
+		Type:     []byte(nil),
+		Codec:    codec.Raw(r.contentType),
+	}
+
+	opts := []bus.PushOption{
+		bus.WithMessageID(r.messageID),
+		bus.WithCorrelationID(r.correlation),
+		bus.WithCausationID(r.causation),
+		bus.WithRoutingKey(r.routingKey),
+		bus.WithTenant(r.tenant),
+		bus.WithTimestamp(time.UnixMilli(r.createdAt)),
+	}
+	if r.headers != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(r.headers), &headers); err != nil {
+			return err
+		}
+		for k, v := range headers {
+			opts = append(opts, bus.WithHeader(k, v))
+		}
+	}
+
+	return b.PushContext(ctx, topic, "", r.body, opts...)
+}
+
+func (o *Outbox) cleanup(ctx context.Context) error {
+	_, err := o.db.ExecContext(ctx,
+		o.dialect.Rebind(`DELETE FROM `+o.table+` WHERE sent_at < ?`),
+		time.Now().Add(-o.retention).UnixMilli(),
+	)
+	return err
+}
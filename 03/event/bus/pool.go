@@ -0,0 +1,179 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// defaultMaxPushConns is the number of connections held open for pushing when
+// SetMaxPushConns has not been called.
+const defaultMaxPushConns = 10
+
+// maxBadConnRetries is the number of times a push is retried on a fresh
+// connection when the driver reports driver.ErrBadConn, same as database/sql.
+const maxBadConnRetries = 2
+
+// ErrBusClosed is returned when pushing on a bus that has been closed.
+var ErrBusClosed = fmt.Errorf("bus is closed")
+
+// connPool holds the long lived connections used for pushing so a push does not
+// need to dial the event bus every time. Connections are handed out to one
+// caller at a time and put back once the push is done.
+type connPool struct {
+	connector driver.Connector
+
+	mu      sync.Mutex
+	free    []driver.Conn
+	numOpen int
+	maxOpen int
+	waiters []chan struct{}
+	closed  bool
+}
+
+func newConnPool(connector driver.Connector) *connPool {
+	return &connPool{
+		connector: connector,
+		maxOpen:   defaultMaxPushConns,
+	}
+}
+
+// conn returns a free connection, opening a new one if the pool is not full,
+// and otherwise waits for one to be released until the context is done.
+func (p *connPool) conn(ctx context.Context) (driver.Conn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrBusClosed
+		}
+
+		if n := len(p.free); n > 0 {
+			c := p.free[n-1]
+			p.free = p.free[:n-1]
+			p.mu.Unlock()
+			return c, nil
+		}
+
+		if p.maxOpen <= 0 || p.numOpen < p.maxOpen {
+			p.numOpen++
+			p.mu.Unlock()
+
+			c, err := p.connector.Connect(ctx)
+			if err != nil {
+				p.mu.Lock()
+				p.numOpen--
+				p.signal()
+				p.mu.Unlock()
+				return nil, err
+			}
+			return c, nil
+		}
+
+		wait := make(chan struct{})
+		p.waiters = append(p.waiters, wait)
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			p.mu.Lock()
+			if !p.removeWaiter(wait) {
+				// we were signalled on the way out, pass it on to the next in line
+				p.signal()
+			}
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release puts the connection back into the pool, unless the push failed with a
+// bad connection, the pool is over its limit or the pool has been closed.
+func (p *connPool) release(c driver.Conn, err error) {
+	p.mu.Lock()
+	if errors.Is(err, driver.ErrBadConn) || p.closed || (p.maxOpen > 0 && p.numOpen > p.maxOpen) {
+		p.numOpen--
+		p.signal()
+		p.mu.Unlock()
+		c.Close()
+		return
+	}
+
+	p.free = append(p.free, c)
+	p.signal()
+	p.mu.Unlock()
+}
+
+func (p *connPool) setMaxOpen(n int) {
+	p.mu.Lock()
+	p.maxOpen = n
+
+	var excess []driver.Conn
+	if n > 0 && p.numOpen > n {
+		drop := p.numOpen - n
+		if drop > len(p.free) {
+			drop = len(p.free)
+		}
+		excess = p.free[:drop]
+		p.free = p.free[drop:]
+		p.numOpen -= drop
+	}
+
+	// wake everyone up, there may be room for them now
+	for len(p.waiters) > 0 {
+		p.signal()
+	}
+	p.mu.Unlock()
+
+	for _, c := range excess {
+		c.Close()
+	}
+}
+
+func (p *connPool) close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	free := p.free
+	p.free = nil
+	p.numOpen -= len(free)
+	for len(p.waiters) > 0 {
+		p.signal()
+	}
+	p.mu.Unlock()
+
+	var err error
+	for _, c := range free {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// signal wakes the longest waiting caller. p.mu must be held.
+func (p *connPool) signal() {
+	if len(p.waiters) == 0 {
+		return
+	}
+	close(p.waiters[0])
+	p.waiters = p.waiters[1:]
+}
+
+// removeWaiter reports whether wait was still queued. p.mu must be held.
+func (p *connPool) removeWaiter(wait chan struct{}) bool {
+	for i, w := range p.waiters {
+		if w == wait {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Package prombus exposes the bus' metrics to Prometheus.
+//
+//	m, err := prombus.New(nil, "movies")
+//	eb.SetMetrics(m)
+//	http.Handle("/metrics", promhttp.Handler())
+//
+// Every driver.Metric is a counter, <namespace>_bus_messages_<metric>_total, and
+// every driver.Timing a histogram, <namespace>_bus_<timing>_duration_seconds,
+// labelled with the driver and the topic.
+package prombus
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+var labels = []string{"driver", "topic"}
+
+var metricHelp = map[driver.Metric]string{
+	driver.MetricPublished:     "Messages pushed onto the bus.",
+	driver.MetricPublishFailed: "Pushes that failed.",
+	driver.MetricConfirmed:     "Pushes confirmed by the broker.",
+	driver.MetricNacked:        "Pushes refused by the broker.",
+	driver.MetricConsumed:      "Messages consumed successfully.",
+	driver.MetricFailed:        "Messages a consumer failed on.",
+	driver.MetricRequeued:      "Failed messages requeued for another attempt.",
+	driver.MetricDeadLettered:  "Messages dead lettered.",
+}
+
+var timingHelp = map[driver.Timing]string{
+	driver.TimingPublish: "How long pushes took, until the broker confirmed them where it does.",
+	driver.TimingHandler: "How long consumers took with a message.",
+}
+
+// Metrics is a bus.Metrics recording to Prometheus collectors.
+type Metrics struct {
+	counters   map[driver.Metric]*prometheus.CounterVec
+	histograms map[driver.Timing]*prometheus.HistogramVec
+}
+
+// New registers the collectors with reg, or the default registerer if it is
+// nil. The namespace prefixes every metric, and may be empty.
+func New(reg prometheus.Registerer, namespace string) (*Metrics, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &Metrics{
+		counters:   make(map[driver.Metric]*prometheus.CounterVec, len(metricHelp)),
+		histograms: make(map[driver.Timing]*prometheus.HistogramVec, len(timingHelp)),
+	}
+
+	for metric, help := range metricHelp {
+		c := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "bus",
+			Name:      "messages_" + string(metric) + "_total",
+			Help:      help,
+		}, labels)
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+		m.counters[metric] = c
+	}
+
+	for timing, help := range timingHelp {
+		h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "bus",
+			Name:      string(timing) + "_duration_seconds",
+			Help:      help,
+			Buckets:   prometheus.DefBuckets,
+		}, labels)
+		if err := reg.Register(h); err != nil {
+			return nil, err
+		}
+		m.histograms[timing] = h
+	}
+
+	return m, nil
+}
+
+func (m *Metrics) Add(metric driver.Metric, driverName, topic string) {
+	if c, ok := m.counters[metric]; ok {
+		c.WithLabelValues(driverName, topic).Inc()
+	}
+}
+
+func (m *Metrics) Observe(timing driver.Timing, driverName, topic string, d time.Duration) {
+	if h, ok := m.histograms[timing]; ok {
+		h.WithLabelValues(driverName, topic).Observe(d.Seconds())
+	}
+}
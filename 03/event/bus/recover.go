@@ -0,0 +1,90 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// PanicError is the error a panicking consumer fails with. The message goes down
+// the same retry and dead letter path as any other failure.
+type PanicError struct {
+	// Value is what the consumer panicked with.
+	Value any
+	// Stack is the stack trace of the goroutine where it panicked.
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("consumer panicked: %v", p.Value)
+}
+
+// Unwrap returns the value panicked with if it is an error.
+func (p *PanicError) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+// ErrorHandler is told about every message a consumer fails on, with the error it
+// failed with. Panics are a *PanicError.
+type ErrorHandler func(topic driver.Topic, env Envelope, err error)
+
+// SetErrorHandler sets the handler consumer failures are reported to. It must be
+// set before Subscribe. The default logs panics with their stack trace, drivers
+// log the other failures already.
+func (e *Bus) SetErrorHandler(h ErrorHandler) {
+	e.errorHandler = h
+}
+
+// logPanics is the default ErrorHandler.
+func (e *Bus) logPanics(topic driver.Topic, env Envelope, err error) {
+	var p *PanicError
+	if errors.As(err, &p) {
+		e.logger.Error("consumer panicked",
+			"topic", topic.Name,
+			"message_id", env.ID,
+			"attempt", env.Attempt,
+			"error", p.Value,
+			"stack", string(p.Stack),
+		)
+	}
+}
+
+// handleErrors wraps the topic's consumer so panics are recovered, turned into a
+// *PanicError, and every failure is reported to the error handler. It wraps the
+// middleware, so it also catches panics there.
+func (e *Bus) handleErrors(t driver.Topic) driver.Topic {
+	if t.Consumer == nil {
+		return t
+	}
+
+	h := e.errorHandler
+	if h == nil {
+		h = e.logPanics
+	}
+
+	consumer := recoverPanics(t.Consumer)
+	t.Consumer = func(ctx context.Context, msg driver.Message) error {
+		err := consumer(ctx, msg)
+		if err != nil {
+			h(t, envelopeOf(t, msg), err)
+		}
+		return err
+	}
+	return t
+}
+
+// recoverPanics returns consumer failing with a *PanicError rather than panicking.
+func recoverPanics(consumer driver.Consume) driver.Consume {
+	return func(ctx context.Context, msg driver.Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+		return consumer(ctx, msg)
+	}
+}
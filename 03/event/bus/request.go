@@ -0,0 +1,233 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// DefaultRequestTimeout is how long a request waits for its reply when its
+// context has no deadline of its own.
+const DefaultRequestTimeout = 30 * time.Second
+
+// headerReplyError carries the error a responder failed with, in place of a reply.
+const headerReplyError = "X-Reply-Error"
+
+// ErrRequestUnsupported is returned by Request when the driver doesn't implement
+// driver.ConnRequest.
+var ErrRequestUnsupported = errors.New("bus: driver does not support request/reply")
+
+// ReplyError is returned by Request when the responder failed, with the message
+// of the error it failed with.
+type ReplyError struct {
+	Message string
+}
+
+func (r *ReplyError) Error() string {
+	return "bus: responder failed: " + r.Message
+}
+
+// Request pushes a message onto the topic, the same as PushContext, and waits for
+// a reply from the topic's responder, see Respond. It waits until ctx is done, or
+// DefaultRequestTimeout if ctx has no deadline. The reply is returned as
+// delivered, still encoded, use the generic Request to have it decoded.
+func (e *Bus) Request(
+	ctx context.Context,
+	topic driver.Topic,
+	tenant string,
+	message driver.Message,
+	opts ...PushOption,
+) (driver.Delivery, error) {
+	if topic.Codec == nil {
+		topic.Codec = e.codec
+	}
+
+	env, err := NewEnvelope(topic, message, opts...)
+	if err != nil {
+		return driver.Delivery{}, err
+	}
+	if tenant != "" {
+		env.Tenant = tenant
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	// requests go through the publish middleware like any push, the reply is
+	// picked up on the way past
+	var reply driver.Delivery
+	err = e.publishChain(func(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) error {
+		var err error
+		reply, err = e.request(ctx, topic, env, message)
+		return err
+	})(ctx, topic, env, message)
+	if err != nil {
+		return driver.Delivery{}, err
+	}
+
+	if msg, ok := reply.Envelope.Headers[headerReplyError]; ok {
+		return reply, &ReplyError{Message: msg}
+	}
+	return reply, nil
+}
+
+// request pushes the request the same way as push, so it is measured the same,
+// then waits for the reply.
+func (e *Bus) request(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) (driver.Delivery, error) {
+	var replies <-chan requestResult
+	err := e.send(ctx, topic, env, func(ctx context.Context, env Envelope) error {
+		var err error
+		replies, err = e.requestConn(ctx, topic, env, message)
+		return err
+	})
+	if err != nil {
+		return driver.Delivery{}, err
+	}
+
+	r := <-replies
+	return r.reply, r.err
+}
+
+type requestResult struct {
+	reply driver.Delivery
+	err   error
+}
+
+// requestConn borrows a connection from the pool for a single request. It
+// returns once the request has been pushed, see driver.RequestSent, with the
+// reply still to come, the connection being released when it does.
+func (e *Bus) requestConn(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) (<-chan requestResult, error) {
+	c, err := e.pool.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, ok := c.(driver.ConnRequest)
+	if !ok {
+		e.pool.release(c, nil)
+		return nil, ErrRequestUnsupported
+	}
+
+	sent := make(chan struct{})
+	var once sync.Once
+	ctx = driver.WithRequestSent(ctx, func() {
+		once.Do(func() { close(sent) })
+	})
+
+	replies := make(chan requestResult, 1)
+	go func() {
+		reply, err := rc.Request(ctx, topic, env, message)
+		e.pool.release(c, err)
+		replies <- requestResult{reply, err}
+	}()
+
+	select {
+	case <-sent:
+		return replies, nil
+	case r := <-replies:
+		done := make(chan requestResult, 1)
+		done <- r
+		select {
+		case <-sent:
+			return done, nil
+		default:
+		}
+		// it failed before it was sent, or the driver doesn't say when it was
+		if r.err != nil {
+			return nil, r.err
+		}
+		return done, nil
+	}
+}
+
+// Request pushes msg onto the topic and decodes the reply into a Resp, see
+// Bus.Request.
+func Request[Req, Resp any](ctx context.Context, b *Bus, topic Topic[Req], msg Req, opts ...PushOption) (Resp, error) {
+	var resp Resp
+	reply, err := b.Request(ctx, topic.Topic, "", msg, opts...)
+	if err != nil {
+		return resp, err
+	}
+	return decode[Resp](reply, topic.Codec)
+}
+
+// Respond registers f as the consumer for the topic, replying to each request
+// with what f returns. If f fails, the requester gets a *ReplyError rather than
+// the message being retried, as the requester is waiting on it. Messages pushed
+// onto the topic other than by Request have nowhere to reply to, and are dropped.
+func Respond[Req, Resp any](b *Bus, topic Topic[Req], f func(ctx context.Context, req Req) (Resp, error)) error {
+	c := topic.Codec
+	return HandleEnvelope(b, topic, func(ctx context.Context, env Envelope, req Req) error {
+		if env.ReplyTo == "" {
+			b.logger.Warn("message on a request topic is not a request, dropping",
+				"topic", env.Topic,
+				"message_id", env.ID,
+			)
+			return nil
+		}
+
+		resp, err := f(ctx, req)
+		return b.reply(ctx, env, c, resp, err)
+	})
+}
+
+// reply sends the reply to the request with the given envelope, either the
+// response encoded or the error the responder failed with.
+func (e *Bus) reply(ctx context.Context, req Envelope, c driver.Codec, resp any, failed error) error {
+	if c == nil {
+		c = e.codec
+	}
+
+	env, err := newEnvelope([]PushOption{CausedBy(req), WithTenant(req.Tenant)})
+	if err != nil {
+		return err
+	}
+	env.Topic = req.Topic
+	env.RoutingKey = req.RoutingKey
+
+	d := driver.Delivery{Envelope: env}
+	if failed != nil {
+		d.Envelope.Headers = map[string]string{headerReplyError: failed.Error()}
+	} else {
+		body, err := c.Marshal(resp)
+		if err != nil {
+			return fmt.Errorf("unable to encode reply: %w", err)
+		}
+		d.ContentType = c.ContentType()
+		d.Body = body
+	}
+	d.Envelope.Headers = e.inject(ctx, d.Envelope.Headers)
+
+	for i := 0; i < maxBadConnRetries; i++ {
+		err = e.replyConn(ctx, req.ReplyTo, d)
+		if !errors.Is(err, driver.ErrBadConn) {
+			break
+		}
+	}
+	return err
+}
+
+// replyConn borrows a connection from the pool for a single reply.
+func (e *Bus) replyConn(ctx context.Context, replyTo string, d driver.Delivery) error {
+	c, err := e.pool.conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	rc, ok := c.(driver.ConnRequest)
+	if !ok {
+		e.pool.release(c, nil)
+		return ErrRequestUnsupported
+	}
+
+	err = rc.Reply(ctx, replyTo, d)
+	e.pool.release(c, err)
+	return err
+}
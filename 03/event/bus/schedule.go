@@ -0,0 +1,243 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+const (
+	// schedulePollInterval is how long RunScheduler waits before looking for due
+	// messages again when there were none.
+	schedulePollInterval = time.Second
+
+	// scheduleBatch is how many due messages RunScheduler takes at once.
+	scheduleBatch = 100
+
+	// scheduleLease is how long a due message is held for the scheduler pushing
+	// it, before other schedulers may push it instead.
+	scheduleLease = time.Minute
+)
+
+// ErrDelayUnsupported is returned by PushAt when the driver can't delay messages
+// itself and no scheduler is set.
+var ErrDelayUnsupported = errors.New("bus: driver does not support delayed messages, and no scheduler is set")
+
+// errNoPushAt is returned by pushAtConn for drivers without driver.ConnPushAt,
+// for pushAt to fall back to the scheduler.
+var errNoPushAt = errors.New("bus: driver does not implement PushAt")
+
+// Scheduled is a message held in a ScheduleStore until it is due, encoded
+// already.
+type Scheduled struct {
+	Topic       string
+	Exchange    string
+	Envelope    Envelope
+	ContentType string
+	Body        []byte
+	At          time.Time
+}
+
+// ScheduleStore holds messages pushed for later, for drivers that can't hold on
+// to them themselves. See package schedule for a store on SQL.
+type ScheduleStore interface {
+	// Schedule stores the message until it is due.
+	Schedule(ctx context.Context, msg Scheduled) error
+	// Due returns up to limit messages due by now, leasing them for lease so
+	// other schedulers don't take them too. Messages not done by the time the
+	// lease runs out are due again.
+	Due(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]Scheduled, error)
+	// Done removes the message with the given ID, once it has been pushed.
+	Done(ctx context.Context, id string) error
+}
+
+// SetScheduler sets where messages pushed with PushAt are held until they are
+// due, when the driver can't hold on to them itself. RunScheduler pushes them
+// once they are. A nil store turns it off, and PushAt fails on such drivers.
+func (e *Bus) SetScheduler(store ScheduleStore) {
+	e.scheduler = store
+}
+
+// PushAt pushes a message onto the topic to be delivered at the given time,
+// rather than straight away, e.g. a reminder the day before a release. It is
+// delivered no earlier than at, and may be later depending on the driver.
+//
+// Drivers implementing driver.ConnPushAt hold on to the message themselves; for
+// the rest it is held in the store set by SetScheduler. A time that has passed
+// already is pushed as PushContext does. The tenant can be set with WithTenant.
+func (e *Bus) PushAt(ctx context.Context, topic driver.Topic, message driver.Message, at time.Time, opts ...PushOption) error {
+	if topic.Codec == nil {
+		topic.Codec = e.codec
+	}
+
+	env, err := NewEnvelope(topic, message, opts...)
+	if err != nil {
+		return err
+	}
+
+	return e.publishChain(func(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message) error {
+		if !at.After(time.Now()) {
+			return e.push(ctx, topic, env, message)
+		}
+		return e.pushAt(ctx, topic, env, message, at)
+	})(ctx, topic, env, message)
+}
+
+// PushAfter is PushAt for a delay from now, such as backing off before trying
+// something again.
+func (e *Bus) PushAfter(ctx context.Context, topic driver.Topic, message driver.Message, delay time.Duration, opts ...PushOption) error {
+	return e.PushAt(ctx, topic, message, time.Now().Add(delay), opts...)
+}
+
+// PublishAt is PushAt for typed topics.
+func PublishAt[T any](ctx context.Context, b *Bus, topic Topic[T], msg T, at time.Time, opts ...PushOption) error {
+	return b.PushAt(ctx, topic.Topic, msg, at, opts...)
+}
+
+// PublishAfter is PushAfter for typed topics.
+func PublishAfter[T any](ctx context.Context, b *Bus, topic Topic[T], msg T, delay time.Duration, opts ...PushOption) error {
+	return b.PushAfter(ctx, topic.Topic, msg, delay, opts...)
+}
+
+func (e *Bus) pushAt(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message, at time.Time) error {
+	env.Headers = e.inject(ctx, env.Headers)
+
+	var err error
+	for i := 0; i < maxBadConnRetries; i++ {
+		err = e.pushAtConn(ctx, topic, env, message, at)
+		if !errors.Is(err, driver.ErrBadConn) {
+			break
+		}
+	}
+	if errors.Is(err, errNoPushAt) {
+		// counted as published once the scheduler pushes it
+		if err = e.schedule(ctx, topic, env, message, at); err == nil {
+			return nil
+		}
+	}
+
+	if err != nil {
+		e.metrics.Add(driver.MetricPublishFailed, topic.Name)
+		return err
+	}
+	e.metrics.Add(driver.MetricPublished, topic.Name)
+	return nil
+}
+
+// pushAtConn borrows a connection from the pool for a single delayed push.
+func (e *Bus) pushAtConn(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message, at time.Time) error {
+	c, err := e.pool.conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	pa, ok := c.(driver.ConnPushAt)
+	if !ok {
+		e.pool.release(c, nil)
+		return errNoPushAt
+	}
+
+	err = pa.PushAt(ctx, topic, env, message, at)
+	e.pool.release(c, err)
+	return err
+}
+
+// schedule stores the message in the scheduler's store until it is due.
+func (e *Bus) schedule(ctx context.Context, topic driver.Topic, env Envelope, message driver.Message, at time.Time) error {
+	if e.scheduler == nil {
+		return ErrDelayUnsupported
+	}
+
+	body, err := topic.Codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	err = e.scheduler.Schedule(ctx, Scheduled{
+		Topic:       topic.Name,
+		Exchange:    topic.Exchange,
+		Envelope:    env,
+		ContentType: topic.Codec.ContentType(),
+		Body:        body,
+		At:          at,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to schedule message: %w", err)
+	}
+	return nil
+}
+
+// RunScheduler pushes the messages held by the scheduler's store as they fall
+// due, until ctx is done. It needs running by at least one instance of the
+// service for PushAt to work on drivers without driver.ConnPushAt; running it in
+// several is fine, they lease messages from the store between them.
+//
+// A message is done once the bus has it, so a crash in between means pushing it
+// again: delivery is at least once, the same as anything else on the bus.
+func (e *Bus) RunScheduler(ctx context.Context) error {
+	if e.scheduler == nil {
+		return fmt.Errorf("bus: no scheduler set")
+	}
+
+	for {
+		n, err := e.runScheduled(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			e.logger.Error("scheduler unable to fetch due messages", "error", err)
+		}
+
+		// a full batch means there is probably more due
+		if err == nil && n == scheduleBatch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(schedulePollInterval):
+		}
+	}
+}
+
+// runScheduled pushes a batch of due messages, returning how many were due.
+func (e *Bus) runScheduled(ctx context.Context) (int, error) {
+	due, err := e.scheduler.Due(ctx, time.Now(), scheduleBatch, scheduleLease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, msg := range due {
+		topic := driver.Topic{
+			Name:     msg.Topic,
+			Exchange: msg.Exchange,
+			Type:     []byte(nil),
+			Codec:    codec.Raw(msg.ContentType),
+		}
+
+		// the publish middleware saw it when it was scheduled
+		if err := e.push(ctx, topic, msg.Envelope, msg.Body); err != nil {
+			// left for its lease to run out and be tried again
+			e.logger.Error("scheduler unable to push message",
+				"topic", msg.Topic,
+				"message_id", msg.Envelope.ID,
+				"error", err,
+			)
+			continue
+		}
+
+		if err := e.scheduler.Done(ctx, msg.Envelope.ID); err != nil {
+			e.logger.Error("scheduler unable to mark message done, it will be pushed again",
+				"topic", msg.Topic,
+				"message_id", msg.Envelope.ID,
+				"error", err,
+			)
+		}
+	}
+	return len(due), nil
+}
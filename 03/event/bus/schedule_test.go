@@ -0,0 +1,185 @@
+package bus_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/schedule"
+)
+
+type message struct {
+	N int
+}
+
+var movieRelease = bus.NewTopic[message]("movie.release", "movie")
+
+// stub is a driver that can't delay messages, recording what is pushed.
+type stub struct {
+	mu     sync.Mutex
+	pushed []pushed
+}
+
+type pushed struct {
+	env  driver.Envelope
+	body string
+}
+
+func (s *stub) Connect(ctx context.Context) (driver.Conn, error) {
+	return stubConn{s}, nil
+}
+
+func (s *stub) received() []pushed {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]pushed(nil), s.pushed...)
+}
+
+type stubConn struct {
+	s *stub
+}
+
+func (c stubConn) Push(ctx context.Context, topic driver.Topic, msg driver.Message) error {
+	return c.PushEnvelope(ctx, topic, driver.Envelope{}, msg)
+}
+
+func (c stubConn) PushEnvelope(ctx context.Context, topic driver.Topic, env driver.Envelope, msg driver.Message) error {
+	body, err := topic.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.s.pushed = append(c.s.pushed, pushed{env: env, body: string(body)})
+	return nil
+}
+
+func (c stubConn) Subscribe(ctx context.Context, topics []driver.Topic) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (c stubConn) Close() error {
+	return nil
+}
+
+// newStore returns a schedule store on a SQLite database of the test's own, and
+// the database.
+func newStore(t *testing.T) (*schedule.SQLStore, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "schedule.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s, err := schedule.NewSQL(db, schedule.SQLite, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+// scheduled returns how many messages are left in the store.
+func scheduled(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM bus_scheduled`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPushAtWithoutScheduler(t *testing.T) {
+	s := &stub{}
+	b := bus.OpenConnector(s)
+
+	err := bus.PublishAfter(context.Background(), b, movieRelease, message{N: 1}, time.Hour)
+	if !errors.Is(err, bus.ErrDelayUnsupported) {
+		t.Fatalf("got %v, want ErrDelayUnsupported", err)
+	}
+	if got := s.received(); len(got) != 0 {
+		t.Fatalf("pushed %v", got)
+	}
+
+	// only messages for later need holding on to
+	if err := bus.PublishAt(context.Background(), b, movieRelease, message{N: 2}, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.received(); len(got) != 1 || got[0].body != `{"N":2}` {
+		t.Fatalf("got %v, want the message pushed straight away", got)
+	}
+	if err := b.RunScheduler(context.Background()); err == nil {
+		t.Fatal("scheduler ran without a store")
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := &stub{}
+	b := bus.OpenConnector(s)
+	store, db := newStore(t)
+	b.SetScheduler(store)
+	ctx := context.Background()
+
+	at := time.Now().Add(200 * time.Millisecond)
+	if err := bus.PublishAt(ctx, b, movieRelease, message{N: 1}, at, bus.WithTenant("acme")); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.received(); len(got) != 0 {
+		t.Fatalf("pushed %v before it was due", got)
+	}
+	if n := scheduled(t, db); n != 1 {
+		t.Fatalf("%d messages scheduled, want 1", n)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.RunScheduler(runCtx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("scheduler: %v", err)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the scheduler to push")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if time.Now().Before(at) {
+		t.Fatal("pushed before it was due")
+	}
+
+	got := s.received()[0]
+	if got.body != `{"N":1}` || got.env.Tenant != "acme" || got.env.RoutingKey != "movie.release" || got.env.ID == "" {
+		t.Fatalf("got %+v", got)
+	}
+
+	// it is done with once pushed
+	deadline = time.Now().Add(5 * time.Second)
+	for scheduled(t, db) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pushed message left in the store")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := len(s.received()); n != 1 {
+		t.Fatalf("pushed %d times, want 1", n)
+	}
+}
@@ -0,0 +1,105 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// Topic is a topic whose messages are always of type T, so pushing onto it and
+// consuming from it is type checked at compile time rather than by the driver.
+type Topic[T any] struct {
+	driver.Topic
+}
+
+// NewTopic creates a topic on the given exchange carrying messages of type T.
+func NewTopic[T any](name, exchange string) Topic[T] {
+	var zero T
+	return Topic[T]{
+		Topic: driver.Topic{
+			Name:     name,
+			Type:     zero,
+			Exchange: exchange,
+		},
+	}
+}
+
+// Publish pushes msg onto the topic, the options fill in its envelope.
+func Publish[T any](ctx context.Context, b *Bus, topic Topic[T], msg T, opts ...PushOption) error {
+	return b.PushContext(ctx, topic.Topic, "", msg, opts...)
+}
+
+// Handle registers f as the consumer for the topic. Whatever the driver delivers
+// is decoded into a T before f is called.
+func Handle[T any](b *Bus, topic Topic[T], f func(ctx context.Context, msg T) error) error {
+	return HandleEnvelope(b, topic, func(ctx context.Context, _ Envelope, msg T) error {
+		return f(ctx, msg)
+	})
+}
+
+// HandleEnvelope is Handle for consumers that also want the message's envelope.
+func HandleEnvelope[T any](b *Bus, topic Topic[T], f func(ctx context.Context, env Envelope, msg T) error) error {
+	return b.RegisterConsumer(topic.withConsumer(f))
+}
+
+// withConsumer returns the driver.Topic with a consumer decoding messages for f.
+func (t Topic[T]) withConsumer(f func(ctx context.Context, env Envelope, msg T) error) driver.Topic {
+	topic := t.Topic
+	topic.Consumer = func(ctx context.Context, msg driver.Message) error {
+		env := Envelope{Topic: topic.Name}
+		if d, ok := msg.(driver.Delivery); ok {
+			env = d.Envelope
+		}
+
+		m, err := decode[T](msg, topic.Codec)
+		if err != nil {
+			return err
+		}
+		return f(ctx, env, m)
+	}
+	return topic
+}
+
+// decode turns what a driver delivers into a T. Drivers either hand over the
+// message as it was pushed, a Delivery to decode by its content type, or the
+// JSON encoded bytes.
+func decode[T any](msg driver.Message, c driver.Codec) (T, error) {
+	var m T
+	switch v := msg.(type) {
+	case T:
+		return v, nil
+	case driver.Delivery:
+		dc, err := decoder(v.ContentType, c)
+		if err != nil {
+			return m, err
+		}
+		if err := dc.Unmarshal(v.Body, &m); err != nil {
+			return m, fmt.Errorf("unable to decode %s message into %T: %w", dc.ContentType(), m, err)
+		}
+		return m, nil
+	case []byte:
+		if err := json.Unmarshal(v, &m); err != nil {
+			return m, fmt.Errorf("unable to decode message into %T: %w", m, err)
+		}
+		return m, nil
+	}
+	return m, fmt.Errorf("unable to decode message of type %T into %T", msg, m)
+}
+
+// decoder picks the codec for the content type, preferring the topic's own.
+// Messages without a content type are assumed to be JSON, as before codecs.
+func decoder(contentType string, topicCodec driver.Codec) (driver.Codec, error) {
+	if topicCodec != nil && topicCodec.ContentType() == contentType {
+		return topicCodec, nil
+	}
+	if contentType == "" {
+		return codec.JSON, nil
+	}
+	if c, ok := codec.Lookup(contentType); ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("no codec registered for content type %q (forgotten import?)", contentType)
+}
@@ -0,0 +1,148 @@
+package bus
+
+import (
+	"context"
+	"strings"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// W3C Trace Context headers, see https://www.w3.org/TR/trace-context/.
+const (
+	headerTraceParent = "traceparent"
+	headerTraceState  = "tracestate"
+)
+
+// Propagator carries the trace a message is part of across the bus, in the
+// message's headers, so a trace spans the publisher and its consumers. It is the
+// shape of OpenTelemetry's TextMapPropagator on a map carrier, see package otelbus
+// for an adapter.
+type Propagator interface {
+	// Inject writes the trace in ctx to the headers of a message being pushed.
+	Inject(ctx context.Context, headers map[string]string)
+	// Extract returns ctx with the trace found in the headers of a message being
+	// consumed.
+	Extract(ctx context.Context, headers map[string]string) context.Context
+}
+
+// SetPropagator sets how traces are carried from PushContext's context to the
+// context consumers are called with. The default is W3C, without depending on
+// any tracing library. A nil propagator carries nothing. It must be set before
+// Subscribe to apply to consumers.
+func (e *Bus) SetPropagator(p Propagator) {
+	e.propagator = p
+}
+
+// TraceContext is the W3C Trace Context of a message, as it is in its headers.
+type TraceContext struct {
+	TraceParent string
+	TraceState  string
+}
+
+type traceContextKey struct{}
+
+// ContextWithTrace returns ctx carrying tc, for the W3C propagator to push with.
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceFromContext returns the trace context carried by ctx, such as the one a
+// consumer's message was pushed with.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// W3C is a Propagator passing the traceparent and tracestate headers through
+// untouched, from ContextWithTrace on pushing to TraceFromContext on consuming.
+// It doesn't start spans of its own, so a consumer pushing more messages with its
+// context carries the publisher's parent on.
+type W3C struct{}
+
+func (W3C) Inject(ctx context.Context, headers map[string]string) {
+	tc, ok := TraceFromContext(ctx)
+	if !ok || !validTraceParent(tc.TraceParent) {
+		return
+	}
+	headers[headerTraceParent] = tc.TraceParent
+	if tc.TraceState != "" {
+		headers[headerTraceState] = tc.TraceState
+	}
+}
+
+func (W3C) Extract(ctx context.Context, headers map[string]string) context.Context {
+	tp := headers[headerTraceParent]
+	if !validTraceParent(tp) {
+		return ctx
+	}
+	return ContextWithTrace(ctx, TraceContext{TraceParent: tp, TraceState: headers[headerTraceState]})
+}
+
+// validTraceParent reports whether tp is a traceparent header we understand:
+// version-traceid-parentid-flags in lowercase hex, with neither ID all zeros.
+// Later versions may add fields on the end.
+func validTraceParent(tp string) bool {
+	parts := strings.Split(tp, "-")
+	if len(parts) < 4 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return false
+	}
+	for i, n := range []int{2, 32, 16, 2} {
+		if len(parts[i]) != n || !isHex(parts[i]) {
+			return false
+		}
+	}
+	return strings.Trim(parts[1], "0") != "" && strings.Trim(parts[2], "0") != ""
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// InjectTrace returns the headers with the trace in ctx added by p, leaving the
+// caller's map alone. It is for writing messages to be pushed later, such as by
+// package outbox, so they carry the trace they were written in.
+func InjectTrace(ctx context.Context, p Propagator, headers map[string]string) map[string]string {
+	if p == nil {
+		return headers
+	}
+
+	h := make(map[string]string, len(headers)+2)
+	for k, v := range headers {
+		h[k] = v
+	}
+	p.Inject(ctx, h)
+
+	if len(h) == 0 {
+		return headers
+	}
+	return h
+}
+
+// inject returns the headers with the trace in ctx added, leaving the caller's map
+// alone.
+func (e *Bus) inject(ctx context.Context, headers map[string]string) map[string]string {
+	return InjectTrace(ctx, e.propagator, headers)
+}
+
+// extractTrace wraps the topic's consumer so it is called with the trace its
+// message was pushed with. It is outermost, so middleware sees the trace too.
+func (e *Bus) extractTrace(t driver.Topic) driver.Topic {
+	p := e.propagator
+	if p == nil || t.Consumer == nil {
+		return t
+	}
+
+	consumer := t.Consumer
+	t.Consumer = func(ctx context.Context, msg driver.Message) error {
+		if d, ok := msg.(driver.Delivery); ok && len(d.Envelope.Headers) > 0 {
+			ctx = p.Extract(ctx, d.Envelope.Headers)
+		}
+		return consumer(ctx, msg)
+	}
+	return t
+}
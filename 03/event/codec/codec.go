@@ -0,0 +1,121 @@
+// Package codec provides the codecs used to encode messages on the event bus.
+//
+// Codecs are registered by content type, the same way drivers are registered
+// with the bus, so a consumer can decode a message with whatever codec it was
+// pushed with. JSON and gob are registered by this package, other codecs live
+// in their own package to keep their dependencies out of everyone's build:
+//
+//	import _ "github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec/msgpack"
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]driver.Codec)
+)
+
+var (
+	// JSON encodes messages with encoding/json, it is the bus default.
+	JSON driver.Codec = jsonCodec{}
+	// Gob encodes messages with encoding/gob, only useful between Go services.
+	Gob driver.Codec = gobCodec{}
+)
+
+// Register makes a codec available to decode messages of its content type.
+// This should be called in the init() function of the codec implementation.
+func Register(c driver.Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c == nil {
+		panic("codec: register codec is nil")
+	}
+	if _, dup := codecs[c.ContentType()]; dup {
+		panic(fmt.Sprintf("codec: register called twice for content type %s", c.ContentType()))
+	}
+	codecs[c.ContentType()] = c
+}
+
+// Lookup returns the codec registered for the content type.
+func Lookup(contentType string) (driver.Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[contentType]
+	return c, ok
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Raw returns a codec for messages encoded already, such as ones held on to and
+// pushed later, passing their bytes through with the content type they were
+// encoded with. It isn't registered, consumers decode with the codec registered
+// for that content type.
+func Raw(contentType string) driver.Codec {
+	return rawCodec(contentType)
+}
+
+type rawCodec string
+
+func (r rawCodec) ContentType() string {
+	return string(r)
+}
+
+func (r rawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("codec: raw codec can only marshal []byte, got %T", v)
+	}
+	return b, nil
+}
+
+func (r rawCodec) Unmarshal(data []byte, v any) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("codec: raw codec can only unmarshal into *[]byte, got %T", v)
+	}
+	*p = append((*p)[:0], data...)
+	return nil
+}
+
+func init() {
+	Register(JSON)
+	Register(Gob)
+}
@@ -0,0 +1,41 @@
+// Package msgpack provides a MessagePack codec for the event bus, registering
+// itself with package codec when imported.
+package msgpack
+
+import (
+	"bytes"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes messages with MessagePack. Fields are named by their json tags,
+// so existing message types need no changes.
+var Codec driver.Codec = msgpackCodec{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func init() {
+	codec.Register(Codec)
+}
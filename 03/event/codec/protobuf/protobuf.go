@@ -0,0 +1,54 @@
+// Package protobuf provides a protocol buffers codec for the event bus,
+// registering itself with package codec when imported.
+package protobuf
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes messages with protocol buffers, so topics using it must carry
+// generated message types, e.g. bus.NewTopic[*moviepb.Release].
+var Codec driver.Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+
+	// the bus decodes into a pointer to the topic's type, which for protobuf is
+	// itself a pointer that needs allocating first
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		if m, ok := rv.Elem().Interface().(proto.Message); ok {
+			return proto.Unmarshal(data, m)
+		}
+	}
+
+	return fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+}
+
+func init() {
+	codec.Register(Codec)
+}
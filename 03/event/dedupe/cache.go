@@ -0,0 +1,131 @@
+// Package dedupe provides stores for the bus' idempotency layer, see
+// bus.SetDedupe. They record the messages a service has consumed, with a TTL, so
+// the bus can skip redeliveries of them.
+//
+//	eb.SetDedupe(dedupe.NewCache(cache.NewRedis(), "movies:"), 24*time.Hour)
+package dedupe
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/02/cache"
+)
+
+// CacheStore is a dedupe store on a cache.Cache, either in memory or in Redis.
+//
+// The cache has no TTL of its own, so the expiry is stored as the value and
+// checked on reading. Expired keys are deleted from an in-memory cache every so
+// often while marking; Redis drops keys after its own 300 hours whatever the TTL.
+//
+// Caches other than the in-memory one must be safe for concurrent use, as
+// consumers run at once. Those that can fail to read, like Redis, need a
+// GetContext method to say so, otherwise a failure looks like a message that
+// hasn't been seen.
+type CacheStore struct {
+	cache  cache.Cache
+	prefix string
+
+	// mem is the cache when it is in memory, which isn't safe for concurrent use
+	// and is never emptied unless we do it, so mu guards it
+	mem         *cache.InMemoryCache
+	mu          sync.Mutex
+	lastCleanup time.Time
+}
+
+// contextGetter is implemented by caches which can fail to read, telling that
+// apart from a key that isn't there.
+type contextGetter interface {
+	GetContext(ctx context.Context, key string) (any, bool, error)
+}
+
+// NewCache returns a store on c. Keys are prefixed with prefix, so services can
+// share a cache.
+func NewCache(c cache.Cache, prefix string) *CacheStore {
+	s := &CacheStore{cache: c, prefix: prefix, lastCleanup: time.Now()}
+	s.mem, _ = c.(*cache.InMemoryCache)
+	return s
+}
+
+func (s *CacheStore) Seen(ctx context.Context, key string) (bool, error) {
+	v, ok, err := s.get(ctx, s.prefix+key)
+	if err != nil {
+		return false, fmt.Errorf("dedupe: unable to read %q from cache: %w", key, err)
+	}
+	if !ok {
+		return false, nil
+	}
+
+	expires, err := expiry(v)
+	if err != nil {
+		return false, fmt.Errorf("dedupe: %w for %q", err, key)
+	}
+	return time.Now().UnixMilli() < expires, nil
+}
+
+func (s *CacheStore) get(ctx context.Context, key string) (any, bool, error) {
+	if s.mem != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v, ok := s.mem.Get(key)
+		return v, ok, nil
+	}
+
+	if g, ok := s.cache.(contextGetter); ok {
+		return g.GetContext(ctx, key)
+	}
+	v, ok := s.cache.Get(key)
+	return v, ok, nil
+}
+
+func (s *CacheStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	now := time.Now()
+	expires := strconv.FormatInt(now.Add(ttl).UnixMilli(), 10)
+
+	if s.mem == nil {
+		return s.cache.Put(s.prefix+key, expires)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.mem.Put(s.prefix+key, expires); err != nil {
+		return err
+	}
+
+	if now.Sub(s.lastCleanup) > cleanupInterval {
+		s.lastCleanup = now
+		s.cleanup(now)
+	}
+	return nil
+}
+
+// cleanup deletes our expired keys from the in-memory cache, mu must be held.
+func (s *CacheStore) cleanup(now time.Time) {
+	for _, k := range s.mem.Keys() {
+		if !strings.HasPrefix(k, s.prefix) {
+			continue
+		}
+		v, _ := s.mem.Get(k)
+		if expires, err := expiry(v); err == nil && expires <= now.UnixMilli() {
+			s.mem.Delete(k)
+		}
+	}
+}
+
+// expiry parses the expiry stored as a value in the cache.
+func expiry(v any) (int64, error) {
+	// Redis hands back strings, whatever was put
+	str, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected value %T in cache", v)
+	}
+	expires, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected value %q in cache", str)
+	}
+	return expires, nil
+}
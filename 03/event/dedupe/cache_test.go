@@ -0,0 +1,73 @@
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/02/cache"
+)
+
+func TestCacheSeen(t *testing.T) {
+	ctx := context.Background()
+	s := NewCache(cache.NewInMemory(), "svc:")
+
+	if seen, err := s.Seen(ctx, "a"); err != nil || seen {
+		t.Fatalf("Seen before Mark = %v, %v", seen, err)
+	}
+	if err := s.Mark(ctx, "a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := s.Seen(ctx, "a"); err != nil || !seen {
+		t.Fatalf("Seen after Mark = %v, %v", seen, err)
+	}
+
+	if err := s.Mark(ctx, "b", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := s.Seen(ctx, "b"); err != nil || seen {
+		t.Fatalf("Seen after expiry = %v, %v", seen, err)
+	}
+}
+
+func TestCacheCleanup(t *testing.T) {
+	ctx := context.Background()
+	mem := cache.NewInMemory().(*cache.InMemoryCache)
+	mem.Put("other:x", "0")
+	s := NewCache(mem, "svc:")
+
+	if err := s.Mark(ctx, "expired", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.lastCleanup = time.Now().Add(-2 * cleanupInterval)
+	if err := s.Mark(ctx, "live", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := mem.Get("svc:expired"); ok {
+		t.Error("expired key wasn't deleted")
+	}
+	if _, ok := mem.Get("svc:live"); !ok {
+		t.Error("live key was deleted")
+	}
+	if _, ok := mem.Get("other:x"); !ok {
+		t.Error("key without our prefix was deleted")
+	}
+}
+
+// failingCache fails every read, like Redis being down.
+type failingCache struct {
+	cache.Cache
+}
+
+func (failingCache) GetContext(ctx context.Context, key string) (any, bool, error) {
+	return nil, false, errors.New("connection refused")
+}
+
+func TestCacheGetError(t *testing.T) {
+	s := NewCache(failingCache{cache.NewInMemory()}, "svc:")
+	if _, err := s.Seen(context.Background(), "a"); err == nil {
+		t.Fatal("Seen didn't fail when the cache did")
+	}
+}
@@ -0,0 +1,119 @@
+package dedupe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/internal/sqldialect"
+)
+
+// Dialect is the flavour of SQL spoken by the database.
+type Dialect = sqldialect.Dialect
+
+const (
+	Postgres = sqldialect.Postgres
+	SQLite   = sqldialect.SQLite
+)
+
+// DefaultTable is the table used when NewSQL is given no table name.
+const DefaultTable = "bus_dedupe"
+
+// cleanupInterval is how often expired keys are deleted.
+const cleanupInterval = 10 * time.Minute
+
+// SQLStore is a dedupe store on a table in a database. Expired keys are deleted
+// every so often while marking.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+	logger  driver.Logger
+
+	mu          sync.Mutex
+	lastCleanup time.Time
+}
+
+// NewSQL returns a store on the table in db, creating the table if it doesn't
+// exist. An empty table name uses DefaultTable.
+func NewSQL(db *sql.DB, dialect Dialect, table string) (*SQLStore, error) {
+	if table == "" {
+		table = DefaultTable
+	}
+	// it goes straight into the SQL
+	if !sqldialect.ValidIdentifier(table) {
+		return nil, fmt.Errorf("dedupe: invalid table %q", table)
+	}
+
+	s := &SQLStore{
+		db:          db,
+		dialect:     dialect,
+		table:       table,
+		logger:      driver.StdLogger{},
+		lastCleanup: time.Now(),
+	}
+
+	// times are stored as unix milliseconds, so they compare the same on every
+	// database
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+	message_key TEXT PRIMARY KEY,
+	expires_at  BIGINT NOT NULL
+)`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create dedupe table: %w", err)
+	}
+	return s, nil
+}
+
+// SetLogger sets where failures to delete expired keys are logged, such as the
+// bus' Logger. The default is driver.StdLogger.
+func (s *SQLStore) SetLogger(l driver.Logger) {
+	s.logger = l
+}
+
+func (s *SQLStore) Seen(ctx context.Context, key string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx,
+		s.dialect.Rebind(`SELECT 1 FROM `+s.table+` WHERE message_key = ? AND expires_at > ?`),
+		key,
+		time.Now().UnixMilli(),
+	).Scan(&n)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SQLStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	now := time.Now()
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(`INSERT INTO `+s.table+` (message_key, expires_at) VALUES (?, ?)
+ON CONFLICT (message_key) DO UPDATE SET expires_at = excluded.expires_at`),
+		key,
+		now.Add(ttl).UnixMilli(),
+	)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	cleanup := now.Sub(s.lastCleanup) > cleanupInterval
+	if cleanup {
+		s.lastCleanup = now
+	}
+	s.mu.Unlock()
+
+	if cleanup {
+		_, err = s.db.ExecContext(ctx, s.dialect.Rebind(`DELETE FROM `+s.table+` WHERE expires_at <= ?`), now.UnixMilli())
+		if err != nil {
+			// the key is marked, this only leaves the table bigger for a while
+			s.logger.Error("dedupe unable to delete expired keys", "table", s.table, "error", err)
+		}
+	}
+	return nil
+}
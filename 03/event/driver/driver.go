@@ -4,12 +4,24 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
 	"strings"
+	"time"
 )
 
 //go:generate mockgen -source=./driver.go -destination=./mocks/mock_driver.go
-// TODO: remove this when we migrate to go1.18 in `go.mod`
-type any interface{}
+
+// ErrBadConn should be returned by a driver to signal to the bus that a
+// driver.Conn is in a bad state (such as the server having earlier closed the
+// connection) and the bus should retry on a new connection.
+//
+// To prevent duplicate messages, ErrBadConn should NOT be returned if there's a
+// possibility that the broker has already received the message.
+var ErrBadConn = errors.New("driver: bad connection")
 
 // Message reflects the associated topic type-safe struct
 type Message any
@@ -20,24 +32,391 @@ type Driver interface {
 	OpenConnector() (Connector, error)
 }
 
-// Topic type safe struct
+// DriverDSN may be implemented by Driver to be configured from a data source
+// name, the same as sql.Open's. The format of the DSN is driver specific. If a
+// Driver does not implement it, the bus calls OpenConnector and only accepts an
+// empty DSN.
+type DriverDSN interface {
+	OpenConnectorDSN(dsn string) (Connector, error)
+}
+
+// Topic type safe struct. The name is the pattern of routing keys the topic
+// consumes, see Match, and messages are pushed onto it with a concrete routing key
+// matching that pattern.
 type Topic struct {
 	Name     string
-	Type     interface{}
+	Type     any
 	Exchange string
 	Consumer Consume
+	// Retry is how messages the consumer fails on are retried. The zero value
+	// uses DefaultRetryPolicy.
+	Retry RetryPolicy
+	// Concurrency is the most messages on this topic consumed at once. Drivers
+	// consume the topic on that many workers of its own rather than the
+	// subscription's, see Lanes. Zero means the topic shares the subscription's
+	// workers.
+	Concurrency int
+	// Codec encodes messages pushed onto the topic. The bus fills in its default
+	// codec before a topic reaches the driver if it is nil.
+	Codec Codec
+}
+
+// Codec encodes messages to bytes for the event bus and back again.
+type Codec interface {
+	// ContentType is the MIME type stamped on messages encoded by the codec, so
+	// consumers can pick the codec to decode with.
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Delivery is what drivers pass to Consume for an encoded message. The content
+// type is the one the message was pushed with.
+type Delivery struct {
+	Envelope    Envelope
+	ContentType string
+	Body        []byte
+}
+
+// Envelope is the metadata carried alongside a message. Publishers fill in the
+// first half, drivers fill in the rest on delivery.
+type Envelope struct {
+	// ID uniquely identifies the message.
+	ID string
+	// CorrelationID is shared by every message in the same flow, it is the ID of
+	// the message that started it.
+	CorrelationID string
+	// CausationID is the ID of the message that caused this one to be pushed.
+	CausationID string
+	// Tenant the message belongs to, empty if it is not tenant specific.
+	Tenant    string
+	Timestamp time.Time
+	Headers   map[string]string
+
+	// Redelivered is set when the event bus has delivered the message before.
+	Redelivered bool
+	// Attempt is the delivery attempt, starting at 1.
+	Attempt int
+	// Topic is the name of the topic the message was consumed on.
+	Topic string
+	// RoutingKey is the key the message was pushed with.
+	RoutingKey string
+	// ReplyTo is where the reply to a request goes, set by drivers implementing
+	// ConnRequest. It is empty for anything other than a request.
+	ReplyTo string
+}
+
+// ConnPushEnvelope may be implemented by Conn to push a message's envelope with it.
+// If it is not, the bus calls Push and the envelope is not carried to consumers.
+type ConnPushEnvelope interface {
+	PushEnvelope(ctx context.Context, topic Topic, env Envelope, message Message) error
+}
+
+// ConnPushAt may be implemented by Conn to push messages for delivery at a later
+// time, with the event bus holding on to them until then. If it is not, the bus
+// holds on to them itself, see bus.SetScheduler.
+type ConnPushAt interface {
+	// PushAt pushes the message as PushEnvelope does, for it to be delivered no
+	// earlier than at.
+	PushAt(ctx context.Context, topic Topic, env Envelope, message Message, at time.Time) error
+}
+
+// ConnRequest may be implemented by Conn to support request/reply. If it is not,
+// the bus' requests fail with bus.ErrRequestUnsupported.
+type ConnRequest interface {
+	// Request pushes the message as PushEnvelope does, with an address for the
+	// reply that consumers get as the envelope's ReplyTo, calls RequestSent once
+	// it has, and waits until ctx is done for the reply: the first message sent
+	// there with the request's ID as its CausationID.
+	Request(ctx context.Context, topic Topic, env Envelope, message Message) (Delivery, error)
+	// Reply sends a reply, already encoded, to the address a request was
+	// delivered with. A requester that has stopped waiting is not an error.
+	Reply(ctx context.Context, replyTo string, reply Delivery) error
+}
+
+// RequestSent is called by ConnRequest.Request, with the ctx it was given, once
+// the request has been pushed and before waiting for the reply. The bus measures
+// the push up to there, the same as any other. Without it the wait for the reply
+// is measured as well.
+func RequestSent(ctx context.Context) {
+	if f, ok := ctx.Value(requestSentKey{}).(func()); ok {
+		f()
+	}
+}
+
+// WithRequestSent returns a context for ConnRequest.Request on which RequestSent
+// calls f.
+func WithRequestSent(ctx context.Context, f func()) context.Context {
+	return context.WithValue(ctx, requestSentKey{}, f)
+}
+
+type requestSentKey struct{}
+
+// RetryPolicy describes how a message that failed to be consumed is retried
+// before it is given up on and dead lettered.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a message is delivered, including the
+	// first, before it is dead lettered.
+	MaxAttempts int
+	// Delay is the wait before the first retry, doubling on every attempt up to
+	// MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used by topics that don't set their own.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Delay:       time.Second,
+	MaxDelay:    time.Minute,
+}
+
+// Backoff returns how long to wait before retrying a message that failed on
+// the given attempt, starting at 1.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	return Backoff(attempt, p.Delay, p.MaxDelay)
+}
+
+// Backoff returns how long to wait before the given attempt at something, such
+// as reconnecting, starting at 1. The delay starts at initial and doubles every
+// attempt up to max, without a max it stays at initial.
+func Backoff(attempt int, initial, max time.Duration) time.Duration {
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// Jitter takes up to half of d off at random, so a fleet of services backing off
+// together, say after the broker restarts, don't all try again in lockstep.
+func Jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// Delays returns every distinct Backoff the policy can produce, in order. Drivers
+// that need to declare something per delay, like a delay queue, can use it.
+func (p RetryPolicy) Delays() []time.Duration {
+	var delays []time.Duration
+	for attempt := 1; attempt < p.MaxAttempts; attempt++ {
+		d := p.Backoff(attempt)
+		if len(delays) > 0 && delays[len(delays)-1] == d {
+			continue
+		}
+		delays = append(delays, d)
+	}
+	return delays
 }
 
 // Connector is the interface to provide a connection to an event bus.
 type Connector interface {
 	// Connect opens a connection with the event bus on the given context.
-	Connect() (Conn, error)
+	//
+	// The returned connection is only used by one goroutine at a time and may
+	// be pooled by the bus and reused for many pushes, so it should be cheap to
+	// keep open.
+	Connect(ctx context.Context) (Conn, error)
+}
+
+// ConnState describes the state of a driver's connection to the event bus.
+type ConnState int
+
+const (
+	// StateConnected is reported once a lost connection has been re-established.
+	StateConnected ConnState = iota
+	// StateDisconnected is reported when the connection to the event bus is lost.
+	StateDisconnected
+	// StateReconnecting is reported before every attempt to reconnect.
+	StateReconnecting
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// ConnEvent is reported by a driver when its connection state changes.
+type ConnEvent struct {
+	State ConnState
+	// Attempt is the reconnect attempt, starting at 1, when reconnecting.
+	Attempt int
+	// Err is why the connection was lost, or why the last attempt failed.
+	Err error
+}
+
+// ConnStateNotifier may be implemented by a Connector to report changes to the
+// state of its connection to the event bus, such as the broker going away and
+// the attempts to reconnect to it.
+type ConnStateNotifier interface {
+	// NotifyState registers f to be called on every state change. f must not block.
+	NotifyState(f func(ConnEvent))
+}
+
+// Metric is something that happened to a message, counted by Metrics.
+type Metric string
+
+const (
+	// MetricPublished is a message pushed, counted by the bus.
+	MetricPublished Metric = "published"
+	// MetricPublishFailed is a push that failed, counted by the bus.
+	MetricPublishFailed Metric = "publish_failed"
+	// MetricConfirmed is a push the broker confirmed, counted by drivers with
+	// publisher confirms.
+	MetricConfirmed Metric = "confirmed"
+	// MetricNacked is a push the broker refused, counted by drivers with
+	// publisher confirms.
+	MetricNacked Metric = "nacked"
+	// MetricConsumed is a message a consumer succeeded on, counted by the bus.
+	MetricConsumed Metric = "consumed"
+	// MetricFailed is a message a consumer failed on, counted by the bus.
+	MetricFailed Metric = "failed"
+	// MetricRequeued is a failed message put back for another attempt, counted
+	// by drivers.
+	MetricRequeued Metric = "requeued"
+	// MetricDeadLettered is a message out of attempts, or one that can't be
+	// consumed at all, counted by drivers.
+	MetricDeadLettered Metric = "dead_lettered"
+)
+
+// Timing is a duration observed by Metrics.
+type Timing string
+
+const (
+	// TimingPublish is how long a push took, until the broker confirmed it on
+	// drivers with publisher confirms.
+	TimingPublish Timing = "publish"
+	// TimingHandler is how long a consumer took with a message.
+	TimingHandler Timing = "handler"
+)
+
+// Metrics records what happens to messages on a topic. It must be safe for
+// concurrent use.
+type Metrics interface {
+	Add(m Metric, topic string)
+	Observe(t Timing, topic string, d time.Duration)
+}
+
+// NopMetrics discards everything, for drivers to record to until they are given
+// Metrics.
+type NopMetrics struct{}
+
+func (NopMetrics) Add(Metric, string)                    {}
+func (NopMetrics) Observe(Timing, string, time.Duration) {}
+
+// ConnectorMetrics may be implemented by a Connector to count what happens to
+// messages that only the driver sees, such as messages requeued for a retry. It
+// is called before the connector is used.
+type ConnectorMetrics interface {
+	SetMetrics(m Metrics)
+}
+
+// Logger is what the bus and drivers log to. The args are structured fields, as
+// alternating keys and values, the same as log/slog: *slog.Logger satisfies it.
+//
+// Drivers use the keys "topic", "routing_key", "message_id", "attempt" and
+// "error" for those, and pass message bodies as a []byte under "payload", for
+// the bus to redact or truncate.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// ConnectorLogger may be implemented by a Connector to log to the bus' Logger. It
+// is called before the connector is used, and until it is, drivers log with
+// StdLogger.
+type ConnectorLogger interface {
+	SetLogger(l Logger)
+}
+
+// StdLogger is a Logger writing to the standard library's log package, as
+// "LEVEL msg key=value ...". Debug messages are dropped, and so are payloads,
+// leaving their size.
+type StdLogger struct{}
+
+func (StdLogger) Debug(msg string, args ...any) {}
+
+func (StdLogger) Info(msg string, args ...any) {
+	stdLog("INFO", msg, args)
+}
+
+func (StdLogger) Warn(msg string, args ...any) {
+	stdLog("WARN", msg, args)
+}
+
+func (StdLogger) Error(msg string, args ...any) {
+	stdLog("ERROR", msg, args)
+}
+
+func stdLog(level, msg string, args []any) {
+	var sb strings.Builder
+	sb.WriteString(level)
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+
+	for i := 0; i < len(args); i += 2 {
+		key, value := fmt.Sprint(args[i]), "!MISSING"
+		if i+1 < len(args) {
+			value = fmt.Sprint(args[i+1])
+			// payloads, never written out unless the bus was told to
+			if b, ok := args[i+1].([]byte); ok {
+				value = fmt.Sprintf("[%d bytes]", len(b))
+			}
+		}
+		if strings.ContainsAny(value, " =\"\n") || value == "" {
+			value = strconv.Quote(value)
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(key)
+		sb.WriteByte('=')
+		sb.WriteString(value)
+	}
+
+	log.Print(sb.String())
 }
 
 // Consume provides a type of function for consuming messages. The type for msg
 // is determined by the driver, and thus the driver's documentation
 // should be referenced on what type to assert msg as in order to work with it.
-type Consume func(msg Message) error
+// Drivers that encode messages should pass a Delivery, so the bus can decode it
+// with the codec it was pushed with.
+//
+// The context carries values for the message, such as the trace it is part of.
+// Drivers pass one from ConsumeContext, which isn't cancelled on unsubscribing, as
+// messages in flight are left to finish then, only once the conn is closed.
+type Consume func(ctx context.Context, msg Message) error
+
+// ConsumeContext returns the context for consumers of a subscription on ctx. It
+// has ctx's values but not its cancellation, so messages in flight can finish
+// when unsubscribing, and is cancelled by stop instead. Drivers call stop when
+// the conn is closed, which the bus does once unsubscribing has run out of time,
+// so consumers still busy by then can give up too.
+func ConsumeContext(ctx context.Context) (consumeCtx context.Context, stop context.CancelFunc) {
+	return context.WithCancel(valuesOnly{ctx})
+}
+
+// valuesOnly is a context with the values of another, that is never done.
+type valuesOnly struct {
+	context.Context
+}
+
+func (valuesOnly) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valuesOnly) Done() <-chan struct{}       { return nil }
+func (valuesOnly) Err() error                  { return nil }
 
 // Conn is the interface for an open event bus connection.
 type Conn interface {
@@ -48,6 +427,36 @@ type Conn interface {
 	// calling the consume function when a message is received on that topic.
 	// There can only be one subscription open per event bus connector.
 	Subscribe(ctx context.Context, topics []Topic) error
+
+	// Close invalidates and potentially stops any current pushes or
+	// subscriptions on the connection.
+	Close() error
+}
+
+// RetryPolicy returns the topic's retry policy, or DefaultRetryPolicy if it has none.
+func (t Topic) RetryPolicy() RetryPolicy {
+	if t.Retry.MaxAttempts == 0 {
+		return DefaultRetryPolicy
+	}
+	return t.Retry
+}
+
+// SubscribeOptions holds the options for a subscription.
+type SubscribeOptions struct {
+	// Workers is the most messages consumed at once across all topics. Drivers
+	// should limit how many messages the event bus sends ahead (prefetch) to
+	// match. Zero leaves it to the driver's default.
+	Workers int
+	// Tenant only consumes messages pushed for this tenant, when set. Messages
+	// for other tenants are acknowledged and skipped, so a subscription for one
+	// tenant should not share its queue with subscriptions for others.
+	Tenant string
+}
+
+// ConnSubscribeWithOptions may be implemented by Conn to take SubscribeOptions.
+// If it is not, the bus calls Subscribe and the options are up to the driver.
+type ConnSubscribeWithOptions interface {
+	SubscribeWithOptions(ctx context.Context, topics []Topic, opts SubscribeOptions) error
 }
 
 // Resource describes the first delimitation which should be the resource type
@@ -59,5 +468,8 @@ func (t Topic) Resource() string {
 // Action describes the middle delimitation which should be the verb acting on the resource
 func (t Topic) Action() string {
 	s := strings.Split(t.Name, ".")
+	if len(s) < 2 {
+		return ""
+	}
 	return s[1]
 }
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt      int
+		initial, max time.Duration
+		want         time.Duration
+	}{
+		{1, time.Second, time.Minute, time.Second},
+		{2, time.Second, time.Minute, 2 * time.Second},
+		{4, time.Second, time.Minute, 8 * time.Second},
+		{7, time.Second, time.Minute, time.Minute},
+		{100, time.Second, time.Minute, time.Minute},
+		// without a max it doesn't grow
+		{3, time.Second, 0, time.Second},
+		{3, 0, time.Minute, 0},
+	}
+
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt, tt.initial, tt.max); got != tt.want {
+			t.Errorf("Backoff(%d, %s, %s) = %s, want %s", tt.attempt, tt.initial, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, Delay: time.Second, MaxDelay: 3 * time.Second}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for i, w := range want {
+		if got := p.Backoff(i + 1); got != w {
+			t.Errorf("Backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+
+	delays := p.Delays()
+	if len(delays) != 3 || delays[0] != time.Second || delays[1] != 2*time.Second || delays[2] != 3*time.Second {
+		t.Errorf("Delays() = %v, want [1s 2s 3s]", delays)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if got := Jitter(0); got != 0 {
+		t.Errorf("Jitter(0) = %s", got)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if got := Jitter(time.Second); got < time.Second/2 || got > time.Second {
+			t.Fatalf("Jitter(1s) = %s, want between 500ms and 1s", got)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package driver
+
+import "sync"
+
+// Lanes gives each topic with a Concurrency a pool of that many workers of its
+// own, so a topic busy up to its limit doesn't tie up the subscription's workers
+// waiting on it, they go on consuming the other topics. Drivers hand a message
+// over with Do once they know which topic it is for, along with everything left
+// to do for it, like acknowledging it.
+//
+// Each lane holds up to its buffer of messages waiting for its workers, only
+// once that is full does handing another over wait for room. Drivers fetching
+// ahead of their workers, like with a prefetch count, should leave room for what
+// the lanes hold, see Held.
+type Lanes struct {
+	lanes map[laneKey]chan func()
+	held  int
+	wg    sync.WaitGroup
+}
+
+type laneKey struct {
+	exchange, name string
+}
+
+// NewLanes starts the workers for the topics with a Concurrency, each lane
+// holding up to buffer messages waiting for them.
+func NewLanes(topics []Topic, buffer int) *Lanes {
+	l := &Lanes{lanes: make(map[laneKey]chan func())}
+	for _, t := range topics {
+		key := laneKey{t.Exchange, t.Name}
+		if t.Concurrency <= 0 || l.lanes[key] != nil {
+			continue
+		}
+
+		lane := make(chan func(), buffer)
+		l.lanes[key] = lane
+		l.held += buffer + t.Concurrency
+		for i := 0; i < t.Concurrency; i++ {
+			l.wg.Add(1)
+			go func() {
+				defer l.wg.Done()
+				for fn := range lane {
+					fn()
+				}
+			}()
+		}
+	}
+	return l
+}
+
+// Do runs fn on a worker of the topic's lane, or straight away if the topic has
+// no lane. It mustn't be called once Close has been.
+func (l *Lanes) Do(t Topic, fn func()) {
+	lane, ok := l.lanes[laneKey{t.Exchange, t.Name}]
+	if !ok {
+		fn()
+		return
+	}
+	lane <- fn
+}
+
+// Held is the most messages the lanes can have at once, being consumed or
+// waiting to be.
+func (l *Lanes) Held() int {
+	return l.held
+}
+
+// Close waits for the lanes to run everything handed to them, then stops their
+// workers.
+func (l *Lanes) Close() {
+	for _, lane := range l.lanes {
+		close(lane)
+	}
+	l.wg.Wait()
+}
@@ -0,0 +1,49 @@
+package driver
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLanes(t *testing.T) {
+	limited := Topic{Name: "movie.release", Exchange: "movie", Concurrency: 2}
+	unlimited := Topic{Name: "movie.rating", Exchange: "movie"}
+	lanes := NewLanes([]Topic{limited, unlimited}, 10)
+
+	if got := lanes.Held(); got != 12 {
+		t.Fatalf("Held() = %d, want 12", got)
+	}
+
+	// run without a lane straight away, on the caller
+	ran := false
+	lanes.Do(unlimited, func() { ran = true })
+	if !ran {
+		t.Fatal("topic without a concurrency wasn't run straight away")
+	}
+
+	var running, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		lanes.Do(limited, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+	lanes.Close()
+
+	if most != 2 {
+		t.Fatalf("%d consumed at once, want 2", most)
+	}
+}
@@ -0,0 +1,70 @@
+package driver
+
+import "strings"
+
+// Match reports whether the routing key matches the pattern, following the same
+// rules as an AMQP topic exchange so every driver routes like RabbitMQ does. Both
+// are split into words on ".", a "*" in the pattern matches exactly one word and a
+// "#" matches zero or more words. Anything else has to match the word exactly.
+func Match(pattern, key string) bool {
+	return matchWords(words(pattern), words(key))
+}
+
+// MatchTopic returns the first topic whose name matches the routing key.
+func MatchTopic(topics []Topic, key string) (Topic, bool) {
+	for _, t := range topics {
+		if Match(t.Name, key) {
+			return t, true
+		}
+	}
+	return Topic{}, false
+}
+
+// IsPattern reports whether s has wildcard words, and so can't be pushed with.
+func IsPattern(s string) bool {
+	for _, w := range words(s) {
+		if w == "*" || w == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+// words splits on ".", the empty string has no words at all rather than a
+// single empty one, the same as the broker.
+func words(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ".")
+}
+
+func matchWords(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return true
+			}
+			// try the rest of the pattern against every suffix of the key,
+			// including the whole key for when # matches nothing
+			for i := 0; i <= len(key); i++ {
+				if matchWords(rest, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(key) == 0 {
+				return false
+			}
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
@@ -0,0 +1,126 @@
+package driver
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		// exact words
+		{"movie.release", "movie.release", true},
+		{"movie.release", "movie.rating", false},
+		{"movie.release", "movie", false},
+		{"movie", "movie.release", false},
+
+		// empty words, which the broker treats as words like any other
+		{"", "", true},
+		{"", "movie", false},
+		{"movie", "", false},
+		{"movie..release", "movie..release", true},
+		{"movie.release", "movie..release", false},
+		{"movie.", "movie.", true},
+		{".movie", ".movie", true},
+
+		// * is exactly one word
+		{"movie.*", "movie.release", true},
+		{"movie.*", "movie", false},
+		{"movie.*", "movie.release.drama", false},
+		{"*.release", "movie.release", true},
+		{"*", "", false},
+		{"*", "movie", true},
+		{"movie.*.drama", "movie.release.drama", true},
+		{"movie.*.drama", "movie.drama", false},
+
+		// * against an empty word
+		{"*", ".", false},
+		{"movie.*", "movie.", true},
+		{"*.release", ".release", true},
+		{"movie.*.drama", "movie..drama", true},
+
+		// # is zero or more words
+		{"#", "", true},
+		{"#", "movie", true},
+		{"#", "movie.release.drama", true},
+		{"movie.#", "movie", true},
+		{"movie.#", "movie.release", true},
+		{"movie.#", "movie.release.drama", true},
+		{"movie.#", "series.release", false},
+		{"movie.#.drama", "movie.drama", true},
+		{"movie.#.drama", "movie.release.drama", true},
+		{"movie.#.drama", "movie.release.new.drama", true},
+		{"movie.#.drama", "movie.release.comedy", false},
+
+		// leading and trailing #
+		{"#.drama", "drama", true},
+		{"#.drama", "movie.release.drama", true},
+		{"#.drama", "movie.drama.release", false},
+		{"#.release.#", "release", true},
+		{"#.release.#", "movie.release.drama", true},
+		{"#.release.#", "movie.rating", false},
+
+		// #.#, and # alongside *
+		{"#.#", "", true},
+		{"#.#", "movie", true},
+		{"#.#", "movie.release.drama", true},
+		{"#.*", "", false},
+		{"#.*", "movie", true},
+		{"*.#", "movie.release", true},
+		{"*.#", "", false},
+		{"movie.#.*", "movie", false},
+		{"movie.#.*", "movie.release.drama", true},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestIsPattern(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"", false},
+		{"movie.release", false},
+		{"movie.*", true},
+		{"#", true},
+		{"movie.#.drama", true},
+		// only whole words are wildcards
+		{"movie.release*", false},
+		{"movie#", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsPattern(tt.s); got != tt.want {
+			t.Errorf("IsPattern(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	topics := []Topic{{Name: "movie.release"}, {Name: "movie.*"}, {Name: "#"}}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"movie.release", "movie.release"},
+		{"movie.rating", "movie.*"},
+		{"series.release", "#"},
+	}
+
+	for _, tt := range tests {
+		got, ok := MatchTopic(topics, tt.key)
+		if !ok || got.Name != tt.want {
+			t.Errorf("MatchTopic(%q) = %q, %v, want %q", tt.key, got.Name, ok, tt.want)
+		}
+	}
+
+	if _, ok := MatchTopic(topics[:2], "series.release"); ok {
+		t.Error("MatchTopic matched a key none of the topics match")
+	}
+}
@@ -0,0 +1,69 @@
+// Package sqldialect is what the packages keeping things in a database through
+// database/sql share, to cope with the SQL spoken by Postgres and SQLite being
+// a little different.
+package sqldialect
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dialect is the flavour of SQL spoken by the database.
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	SQLite
+)
+
+// DriverName is the name the dialect's database/sql driver registers itself as.
+func (d Dialect) DriverName() string {
+	if d == SQLite {
+		return "sqlite3"
+	}
+	return "postgres"
+}
+
+// Blob is the column type for bytes.
+func (d Dialect) Blob() string {
+	if d == SQLite {
+		return "BLOB"
+	}
+	return "BYTEA"
+}
+
+// SerialPrimaryKey is the column type for an auto incrementing primary key.
+func (d Dialect) SerialPrimaryKey() string {
+	if d == SQLite {
+		return "INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+	return "BIGSERIAL PRIMARY KEY"
+}
+
+// Rebind swaps the ? placeholders for $1, $2... on Postgres.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidIdentifier reports whether s is a plain identifier, so a table name can go
+// straight into the SQL.
+func ValidIdentifier(s string) bool {
+	return identifier.MatchString(s)
+}
@@ -0,0 +1,42 @@
+package sqldialect
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{Postgres, "SELECT 1", "SELECT 1"},
+		{Postgres, "UPDATE t SET a = ? WHERE id = ?", "UPDATE t SET a = $1 WHERE id = $2"},
+		{Postgres, "WHERE id IN (?, ?, ?)", "WHERE id IN ($1, $2, $3)"},
+		{SQLite, "UPDATE t SET a = ? WHERE id = ?", "UPDATE t SET a = ? WHERE id = ?"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dialect.Rebind(tt.query); got != tt.want {
+			t.Errorf("Rebind(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestValidIdentifier(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"bus_events", true},
+		{"_events2", true},
+		{"", false},
+		{"2events", false},
+		{"bus.events", false},
+		{"events; DROP TABLE users", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidIdentifier(tt.s); got != tt.want {
+			t.Errorf("ValidIdentifier(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/codec"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+const (
+	// queueSize is the number of messages a subscription can hold before Push blocks.
+	queueSize = 1024
+
+	// defaultWorkers is the number of messages a subscription consumes at once
+	// when the subscribe options don't say.
+	defaultWorkers = 10
+
+	// delayedPushTimeout is how long a message pushed for later waits for room in
+	// full queues once it is due, before it is dropped.
+	delayedPushTimeout = 30 * time.Second
+)
+
+var defaultBroker = newBroker()
+
+// broker fans pushed messages out to every open subscription with a matching topic,
+// the same way a rabbit exchange fans out to every bound queue.
+type broker struct {
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+
+	// replies are the requests waiting on a reply, by the address they gave
+	replies map[string]chan driver.Delivery
+
+	// delayed are the timers holding messages pushed for later, by the connector
+	// which pushed them, so they are stopped when it is closed
+	delayed map[*time.Timer]*connector
+}
+
+type subscription struct {
+	topics  []driver.Topic
+	queue   chan delivery
+	metrics driver.Metrics
+	logger  driver.Logger
+
+	// consumeCtx is what consumers are called with, see driver.ConsumeContext
+	consumeCtx context.Context
+	// lanes consume the topics with a concurrency of their own, so they don't
+	// hold up the workers
+	lanes *driver.Lanes
+
+	// done is closed once the subscription stops taking messages, so pushes
+	// waiting on a full queue give up on it
+	done chan struct{}
+	// mu guards closed, held for reading while sending to the queue so nothing
+	// is queued after the queue has been drained
+	mu     sync.RWMutex
+	closed bool
+}
+
+type delivery struct {
+	exchange string
+	message  driver.Delivery
+	attempt  int
+}
+
+type memory struct {
+	broker    *broker
+	connector *connector
+	metrics   driver.Metrics
+	logger    driver.Logger
+
+	consumeCtx  context.Context
+	stopConsume context.CancelFunc
+}
+
+func newBroker() *broker {
+	return &broker{
+		subs:    make(map[*subscription]struct{}),
+		replies: make(map[string]chan driver.Delivery),
+		delayed: make(map[*time.Timer]*connector),
+	}
+}
+
+func (m *memory) Push(ctx context.Context, topic driver.Topic, msg driver.Message) error {
+	return m.PushEnvelope(ctx, topic, driver.Envelope{Timestamp: time.Now()}, msg)
+}
+
+func (m *memory) PushEnvelope(ctx context.Context, topic driver.Topic, env driver.Envelope, msg driver.Message) error {
+	topic = withCodec(topic)
+
+	// encode it just like a real broker would need, so consumers are tested
+	// against the same bytes they would see from one
+	body, err := topic.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if env.RoutingKey == "" {
+		env.RoutingKey = topic.Name
+	}
+
+	d := delivery{
+		exchange: topic.Exchange,
+		message:  driver.Delivery{Envelope: env, ContentType: topic.Codec.ContentType(), Body: body},
+		attempt:  1,
+	}
+
+	// don't hold the lock while sending, a full queue would block subscriptions
+	// being removed and every other push behind it
+	var subs []*subscription
+	m.broker.mu.RLock()
+	for sub := range m.broker.subs {
+		if _, ok := sub.match(d); ok {
+			subs = append(subs, sub)
+		}
+	}
+	m.broker.mu.RUnlock()
+
+	for _, sub := range subs {
+		if err := sub.send(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send queues the delivery, waiting for room in the queue until ctx is done. A
+// subscription that has stopped is skipped, the same as if it had stopped before
+// the push.
+func (s *subscription) send(ctx context.Context, d delivery) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil
+	}
+
+	select {
+	case s.queue <- d:
+		return nil
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PushAt implements driver.ConnPushAt, holding the message in a timer on the
+// broker. Like anything else in memory it is lost if the process exits first, or
+// the connector is closed.
+func (m *memory) PushAt(ctx context.Context, topic driver.Topic, env driver.Envelope, msg driver.Message, at time.Time) error {
+	topic = withCodec(topic)
+
+	// encode it now, so it fails here rather than when it is due
+	if _, err := topic.Codec.Marshal(msg); err != nil {
+		return err
+	}
+
+	m.broker.mu.Lock()
+	defer m.broker.mu.Unlock()
+	if m.connector.ctx.Err() != nil {
+		return errConnectorClosed
+	}
+
+	// the timer can't fire and take the lock until it is in delayed
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(at), func() {
+		m.broker.mu.Lock()
+		delete(m.broker.delayed, timer)
+		m.broker.mu.Unlock()
+		// it fired as the connector was being closed
+		if m.connector.ctx.Err() != nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(m.connector.ctx, delayedPushTimeout)
+		defer cancel()
+		if err := m.PushEnvelope(ctx, topic, env, msg); err != nil {
+			m.logger.Error("unable to push delayed message",
+				"topic", topic.Name,
+				"message_id", env.ID,
+				"error", err,
+			)
+		}
+	})
+	m.broker.delayed[timer] = m.connector
+	return nil
+}
+
+// Request implements driver.ConnRequest, the reply address is only known to this
+// broker.
+func (m *memory) Request(ctx context.Context, topic driver.Topic, env driver.Envelope, msg driver.Message) (driver.Delivery, error) {
+	env.ReplyTo = "reply." + env.ID
+	replies := make(chan driver.Delivery, 1)
+
+	m.broker.mu.Lock()
+	m.broker.replies[env.ReplyTo] = replies
+	m.broker.mu.Unlock()
+
+	defer func() {
+		m.broker.mu.Lock()
+		delete(m.broker.replies, env.ReplyTo)
+		m.broker.mu.Unlock()
+	}()
+
+	if err := m.PushEnvelope(ctx, topic, env, msg); err != nil {
+		return driver.Delivery{}, err
+	}
+	driver.RequestSent(ctx)
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-ctx.Done():
+		return driver.Delivery{}, ctx.Err()
+	}
+}
+
+// Reply implements driver.ConnRequest. Only the first reply to a request is kept.
+func (m *memory) Reply(ctx context.Context, replyTo string, reply driver.Delivery) error {
+	m.broker.mu.RLock()
+	defer m.broker.mu.RUnlock()
+
+	if replies, ok := m.broker.replies[replyTo]; ok {
+		select {
+		case replies <- reply:
+		default:
+		}
+	}
+	return nil
+}
+
+func (m *memory) Subscribe(ctx context.Context, topics []driver.Topic) error {
+	return m.SubscribeWithOptions(ctx, topics, driver.SubscribeOptions{})
+}
+
+func (m *memory) SubscribeWithOptions(ctx context.Context, topics []driver.Topic, opts driver.SubscribeOptions) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	sub := &subscription{
+		topics:     topics,
+		queue:      make(chan delivery, queueSize),
+		metrics:    m.metrics,
+		logger:     m.logger,
+		consumeCtx: m.consumeCtx,
+		lanes:      driver.NewLanes(topics, workers),
+		done:       make(chan struct{}),
+	}
+
+	m.broker.mu.Lock()
+	m.broker.subs[sub] = struct{}{}
+	m.broker.mu.Unlock()
+
+	// the workers keep consuming after the subscription is stopped, until the
+	// queue has been drained
+	drain := make(chan struct{})
+	var inflight sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			for {
+				select {
+				case d := <-sub.queue:
+					sub.handle(d)
+				case <-drain:
+					sub.drain()
+					return
+				}
+			}
+		}()
+	}
+
+	<-ctx.Done()
+
+	// stop taking on anything new. There is no broker to hand what is queued back
+	// to, so it is consumed before returning, as Unsubscribe waits for.
+	m.broker.mu.Lock()
+	delete(m.broker.subs, sub)
+	m.broker.mu.Unlock()
+
+	close(sub.done)
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+
+	close(drain)
+	inflight.Wait()
+	sub.lanes.Close()
+	return nil
+}
+
+// drain consumes what is left in the queue. It is only called once the
+// subscription is closed, so nothing more is queued.
+func (s *subscription) drain() {
+	for {
+		select {
+		case d := <-s.queue:
+			s.handle(d)
+		default:
+			return
+		}
+	}
+}
+
+// handle passes a delivery to the matching topic consumer, in the topic's lane if
+// it has one.
+func (s *subscription) handle(d delivery) {
+	t, ok := s.match(d)
+	if !ok {
+		return
+	}
+
+	s.lanes.Do(t, func() {
+		s.consume(d, t)
+	})
+}
+
+// consume passes a delivery to the topic's consumer, retrying it if that fails.
+func (s *subscription) consume(d delivery, t driver.Topic) {
+	msg := d.message
+	msg.Envelope.Topic = t.Name
+	msg.Envelope.Attempt = d.attempt
+	msg.Envelope.Redelivered = d.attempt > 1
+
+	if err := t.Consumer(s.consumeCtx, msg); err != nil {
+		s.logger.Warn("consumer had an issue processing an event message",
+			"topic", t.Name,
+			"routing_key", msg.Envelope.RoutingKey,
+			"message_id", msg.Envelope.ID,
+			"attempt", d.attempt,
+			"payload", msg.Body,
+			"error", err,
+		)
+		s.retry(d, t)
+	}
+}
+
+// retry queues the delivery again after the topic's backoff. Once it is out of
+// attempts it is logged and dropped, there is no dead letter queue in memory.
+func (s *subscription) retry(d delivery, t driver.Topic) {
+	policy := t.RetryPolicy()
+	if d.attempt >= policy.MaxAttempts {
+		s.logger.Error("message failed too many times, dropping",
+			"topic", t.Name,
+			"message_id", d.message.Envelope.ID,
+			"attempt", d.attempt,
+		)
+		s.metrics.Add(driver.MetricDeadLettered, t.Name)
+		return
+	}
+	s.metrics.Add(driver.MetricRequeued, t.Name)
+
+	d.attempt++
+	time.AfterFunc(policy.Backoff(d.attempt-1), func() {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		if s.closed {
+			s.logger.Warn("subscription stopped, dropping retry of message",
+				"topic", t.Name,
+				"message_id", d.message.Envelope.ID,
+			)
+			return
+		}
+
+		select {
+		case s.queue <- d:
+		default:
+			s.logger.Error("subscription queue full, dropping retry of message",
+				"topic", t.Name,
+				"message_id", d.message.Envelope.ID,
+			)
+		}
+	})
+}
+
+// Close cancels the context of any consumers still running, there is nothing
+// else held open for a memory connection.
+func (m *memory) Close() error {
+	m.stopConsume()
+	return nil
+}
+
+// match returns the first topic of the subscription the delivery is routed to.
+func (s *subscription) match(d delivery) (driver.Topic, bool) {
+	for _, t := range s.topics {
+		if t.Exchange == d.exchange && driver.Match(t.Name, d.message.Envelope.RoutingKey) {
+			return t, true
+		}
+	}
+	return driver.Topic{}, false
+}
+
+// withCodec gives the topic the bus' default codec if it has none, as it does
+// when pushed on the conn itself rather than through a bus.
+func withCodec(topic driver.Topic) driver.Topic {
+	if topic.Codec == nil {
+		topic.Codec = codec.JSON
+	}
+	return topic
+}
@@ -0,0 +1,640 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+type message struct {
+	N int
+}
+
+var movieRelease = bus.NewTopic[message]("movie.release", "movie")
+
+// open opens a bus on the broker of the test's own, returning the broker too so
+// tests can tell when subscriptions are open. Every bus a test opens is on the
+// same broker, like services sharing a rabbit.
+func open(t *testing.T) (*bus.Bus, *broker) {
+	t.Helper()
+
+	name := strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-"))
+	b, err := bus.Open("memory", "memory://"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brokersMu.Lock()
+	br := brokers[name]
+	brokersMu.Unlock()
+	return b, br
+}
+
+// subscribe subscribes in the background, returning once the subscription is
+// taking messages. It is unsubscribed when the test finishes, if it hasn't been.
+func subscribe(t *testing.T, b *bus.Bus, br *broker, opts driver.SubscribeOptions) {
+	t.Helper()
+
+	br.mu.RLock()
+	before := len(br.subs)
+	br.mu.RUnlock()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.SubscribeWithOptions(opts)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("subscribe: %v", err)
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		br.mu.RLock()
+		n := len(br.subs)
+		br.mu.RUnlock()
+		if n > before {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the subscription")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitFor fails the test if ch isn't closed in time.
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestPushSubscribe(t *testing.T) {
+	b, br := open(t)
+
+	var (
+		mu   sync.Mutex
+		got  []int
+		done = make(chan struct{})
+	)
+	err := bus.HandleEnvelope(b, movieRelease, func(ctx context.Context, env bus.Envelope, msg message) error {
+		if env.Topic != "movie.release" || env.RoutingKey != "movie.release" || env.ID == "" || env.Attempt != 1 {
+			t.Errorf("unexpected envelope %+v", env)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, msg.N)
+		if len(got) == 3 {
+			close(done)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{})
+
+	for i := 1; i <= 3; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, done, "messages")
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Ints(got)
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Fatalf("got %v, want [1 2 3]", got)
+	}
+}
+
+// Pushing on a conn directly, with a topic the bus hasn't given a codec, encodes
+// it as JSON the same as the bus would.
+func TestPushWithoutCodec(t *testing.T) {
+	b, br := open(t)
+
+	got := make(chan message, 2)
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		got <- msg
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{})
+
+	cn := newConnector(br)
+	defer cn.Close()
+	conn, err := cn.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	topic := driver.Topic{Name: "movie.release", Exchange: "movie"}
+	if err := conn.Push(context.Background(), topic, message{N: 1}); err != nil {
+		t.Fatal(err)
+	}
+	err = conn.(driver.ConnPushAt).PushAt(context.Background(), topic, driver.Envelope{ID: "later"}, message{N: 2}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ns []int
+	for len(ns) < 2 {
+		select {
+		case msg := <-got:
+			ns = append(ns, msg.N)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for messages, got %v", ns)
+		}
+	}
+	sort.Ints(ns)
+	if ns[0] != 1 || ns[1] != 2 {
+		t.Fatalf("got %v, want [1 2]", ns)
+	}
+}
+
+func TestPushWithoutSubscribers(t *testing.T) {
+	b, _ := open(t)
+
+	if err := bus.Publish(context.Background(), b, movieRelease, message{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWildcardRouting(t *testing.T) {
+	patterns := []string{"movie.#", "movie.*", "movie.release", "#.drama"}
+
+	tests := []struct {
+		name       string
+		exchange   string
+		routingKey string
+		want       []string
+	}{
+		{"exact", "movie", "movie.release", []string{"movie.#", "movie.*", "movie.release"}},
+		{"one word", "movie", "movie.rating", []string{"movie.#", "movie.*"}},
+		{"many words", "movie", "movie.release.drama", []string{"#.drama", "movie.#"}},
+		{"hash matches no words", "movie", "movie", []string{"movie.#"}},
+		{"other exchange", "series", "movie.release", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu  sync.Mutex
+				got []string
+			)
+			consumed := make(chan struct{}, len(patterns))
+
+			// a bus per pattern, the same as a service each, as a subscription
+			// only gets a message once however many of its topics match
+			for _, pattern := range patterns {
+				pattern := pattern
+				b, br := open(t)
+				err := b.RegisterConsumer(driver.Topic{
+					Name:     pattern,
+					Type:     message{},
+					Exchange: "movie",
+					Consumer: func(ctx context.Context, msg driver.Message) error {
+						mu.Lock()
+						got = append(got, pattern)
+						mu.Unlock()
+						consumed <- struct{}{}
+						return nil
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				subscribe(t, b, br, driver.SubscribeOptions{})
+			}
+
+			b, _ := open(t)
+			topic := driver.Topic{Name: "#", Type: message{}, Exchange: tt.exchange}
+			if err := b.PushContext(context.Background(), topic, "", message{}, bus.WithRoutingKey(tt.routingKey)); err != nil {
+				t.Fatal(err)
+			}
+
+			for range tt.want {
+				select {
+				case <-consumed:
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for messages")
+				}
+			}
+			// give anything that shouldn't have matched the chance to turn up
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("consumed by %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	b, br := open(t)
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond}
+
+	var attempts []int
+	done := make(chan struct{})
+	err := bus.HandleEnvelope(b, topic, func(ctx context.Context, env bus.Envelope, msg message) error {
+		attempts = append(attempts, env.Attempt)
+		if env.Redelivered != (env.Attempt > 1) {
+			t.Errorf("attempt %d redelivered %v", env.Attempt, env.Redelivered)
+		}
+		if env.Attempt < 3 {
+			return errors.New("not yet")
+		}
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one worker, so attempts don't race
+	subscribe(t, b, br, driver.SubscribeOptions{Workers: 1})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, done, "the third attempt")
+
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[1] != 2 || attempts[2] != 3 {
+		t.Fatalf("attempts %v, want [1 2 3]", attempts)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	b, br := open(t)
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 2, Delay: time.Millisecond}
+
+	var attempts int32
+	err := bus.Handle(b, topic, func(ctx context.Context, msg message) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("never")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{Workers: 1})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// long enough for several more backoffs, were it retried again
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("consumed %d times, want 2", n)
+	}
+}
+
+func TestUnsubscribeDrains(t *testing.T) {
+	b, br := open(t)
+
+	release := make(chan struct{})
+	var consumed int32
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		<-release
+		atomic.AddInt32(&consumed, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{Workers: 1})
+
+	// one with the worker, the rest queued
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		defer close(unsubscribed)
+		if err := b.Unsubscribe(context.Background()); err != nil {
+			t.Errorf("unsubscribe: %v", err)
+		}
+	}()
+
+	select {
+	case <-unsubscribed:
+		t.Fatal("unsubscribe returned with messages still being consumed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	waitFor(t, unsubscribed, "unsubscribe")
+
+	if got := atomic.LoadInt32(&consumed); got != n {
+		t.Fatalf("consumed %d messages, want %d", got, n)
+	}
+
+	// it's gone, so pushes don't wait on it
+	if err := bus.Publish(context.Background(), b, movieRelease, message{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A push waiting on a full queue mustn't stop the subscription being removed, or
+// hold up pushes to anyone else.
+func TestUnsubscribeFullQueue(t *testing.T) {
+	b, br := open(t)
+
+	release := make(chan struct{})
+	var consumed int32
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		<-release
+		atomic.AddInt32(&consumed, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{Workers: 1})
+
+	// one with the worker and a full queue
+	for i := 0; i < queueSize+1; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		if err := bus.Publish(context.Background(), b, movieRelease, message{}); err != nil {
+			t.Errorf("blocked push: %v", err)
+		}
+	}()
+
+	// the queue is full, so that push waits
+	select {
+	case <-blocked:
+		t.Fatal("push didn't wait for room in the queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// pushes to other exchanges aren't held up by it
+	other := bus.NewTopic[message]("series.release", "series")
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		if err := bus.Publish(context.Background(), b, other, message{}); err != nil {
+			t.Errorf("push: %v", err)
+		}
+	}()
+	waitFor(t, pushed, "a push to another exchange")
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		defer close(unsubscribed)
+		if err := b.Unsubscribe(context.Background()); err != nil {
+			t.Errorf("unsubscribe: %v", err)
+		}
+	}()
+
+	// the waiting push gives up on the subscription once it is stopped
+	waitFor(t, blocked, "the blocked push")
+
+	close(release)
+	waitFor(t, unsubscribed, "unsubscribe")
+
+	if got := atomic.LoadInt32(&consumed); got != queueSize+1 {
+		t.Fatalf("consumed %d messages, want %d", got, queueSize+1)
+	}
+}
+
+// Consumers keep their context while unsubscribing waits for them, and have it
+// cancelled once unsubscribing runs out of time.
+func TestUnsubscribeTimeoutCancelsConsumers(t *testing.T) {
+	b, br := open(t)
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{Workers: 1})
+
+	if err := bus.Publish(context.Background(), b, movieRelease, message{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, started, "the consumer")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.Unsubscribe(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unsubscribe returned %v, want the deadline exceeded", err)
+	}
+	waitFor(t, cancelled, "the consumer's context to be cancelled")
+}
+
+// A topic busy up to its concurrency doesn't hold up the subscription's workers
+// consuming the others.
+func TestConcurrency(t *testing.T) {
+	b, br := open(t)
+
+	limited := movieRelease
+	limited.Concurrency = 1
+	other := bus.NewTopic[message]("series.release", "series")
+
+	release := make(chan struct{})
+	defer close(release)
+	err := bus.Handle(b, limited, func(ctx context.Context, msg message) error {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumed := make(chan struct{})
+	err = bus.Handle(b, other, func(ctx context.Context, msg message) error {
+		close(consumed)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{Workers: 2})
+
+	// one being consumed, and more than there are workers waiting
+	for i := 0; i < 3; i++ {
+		if err := bus.Publish(context.Background(), b, limited, message{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bus.Publish(context.Background(), b, other, message{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, consumed, "the other topic")
+}
+
+// recorder is bus.Metrics keeping what it was given.
+type recorder struct {
+	mu      sync.Mutex
+	counts  map[driver.Metric]int
+	timings map[driver.Timing][]time.Duration
+}
+
+func (r *recorder) Add(m driver.Metric, driverName, topic string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[m]++
+}
+
+func (r *recorder) Observe(t driver.Timing, driverName, topic string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timings[t] = append(r.timings[t], d)
+}
+
+func TestRequestMetrics(t *testing.T) {
+	b, br := open(t)
+	m := &recorder{counts: map[driver.Metric]int{}, timings: map[driver.Timing][]time.Duration{}}
+	b.SetMetrics(m)
+
+	const wait = 200 * time.Millisecond
+	err := bus.Respond(b, movieRelease, func(ctx context.Context, req message) (message, error) {
+		time.Sleep(wait)
+		return message{N: req.N + 1}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{})
+
+	resp, err := bus.Request[message, message](context.Background(), b, movieRelease, message{N: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.N != 2 {
+		t.Fatalf("got reply %d, want 2", resp.N)
+	}
+
+	// nobody replies to this one, it was still published
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	other := bus.NewTopic[message]("movie.unanswered", "movie")
+	if _, err := bus.Request[message, message](ctx, b, other, message{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline exceeded", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := m.counts[driver.MetricPublished]; n != 2 {
+		t.Errorf("published %d, want 2", n)
+	}
+	if n := m.counts[driver.MetricPublishFailed]; n != 0 {
+		t.Errorf("failed to publish %d, want 0", n)
+	}
+	timings := m.timings[driver.TimingPublish]
+	if len(timings) != 2 {
+		t.Fatalf("got %d publish timings, want 2", len(timings))
+	}
+	if timings[0] >= wait {
+		t.Errorf("publish took %v, the wait for the reply was measured too", timings[0])
+	}
+}
+
+func TestPushAt(t *testing.T) {
+	b, br := open(t)
+
+	var got int32
+	done := make(chan struct{})
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		atomic.AddInt32(&got, 1)
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{})
+
+	at := time.Now().Add(100 * time.Millisecond)
+	if err := b.PushAt(context.Background(), movieRelease.Topic, message{N: 1}, at); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&got) != 0 {
+		t.Fatal("delayed message delivered straight away")
+	}
+	waitFor(t, done, "the delayed message")
+	if time.Now().Before(at) {
+		t.Fatal("delayed message delivered early")
+	}
+}
+
+func TestCloseStopsPushAt(t *testing.T) {
+	b, br := open(t)
+	pusher, _ := open(t)
+
+	var got int32
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		atomic.AddInt32(&got, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, br, driver.SubscribeOptions{})
+
+	ctx := context.Background()
+	if err := pusher.PushAt(ctx, movieRelease.Topic, message{N: 1}, time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pusher.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	br.mu.RLock()
+	n := len(br.delayed)
+	br.mu.RUnlock()
+	if n != 0 {
+		t.Fatalf("%d delayed messages left on the broker", n)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&got); n != 0 {
+		t.Fatalf("got %d messages pushed for later after closing", n)
+	}
+}
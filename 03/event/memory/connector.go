@@ -0,0 +1,73 @@
+package memory
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+var errConnectorClosed = errors.New("memory: connector is closed")
+
+type connector struct {
+	broker  *broker
+	metrics driver.Metrics
+	logger  driver.Logger
+
+	// ctx is cancelled on Close, giving up on delayed pushes waiting for room
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newConnector(b *broker) *connector {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connector{
+		broker:  b,
+		metrics: driver.NopMetrics{},
+		logger:  driver.StdLogger{},
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	consumeCtx, stop := driver.ConsumeContext(ctx)
+	return &memory{
+		broker:      c.broker,
+		connector:   c,
+		metrics:     c.metrics,
+		logger:      c.logger,
+		consumeCtx:  consumeCtx,
+		stopConsume: stop,
+	}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return BusDriver{}
+}
+
+// SetMetrics implements driver.ConnectorMetrics.
+func (c *connector) SetMetrics(m driver.Metrics) {
+	c.metrics = m
+}
+
+// SetLogger implements driver.ConnectorLogger.
+func (c *connector) SetLogger(l driver.Logger) {
+	c.logger = l
+}
+
+// Close stops the messages pushed for later through the connector that aren't
+// due yet, they are dropped. The broker is left to any other connectors on it.
+func (c *connector) Close() error {
+	c.cancel()
+
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	for t, owner := range c.broker.delayed {
+		if owner == c {
+			t.Stop()
+			delete(c.broker.delayed, t)
+		}
+	}
+	return nil
+}
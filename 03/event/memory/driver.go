@@ -0,0 +1,63 @@
+// Package memory provides an in-process implementation of the bus/driver interface.
+// It needs no broker running, which makes it handy for unit testing consumers and
+// for running the demo without Docker.
+//
+// All connectors opened by this driver share a single in-process broker, so a bus
+// opened for pushing and a bus opened for subscribing will see each other's messages,
+// the same as they would through RabbitMQ. A DSN of the form memory://name picks a
+// separate broker by name instead, so tests can run isolated from each other.
+package memory
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+type BusDriver struct{}
+
+// OpenConnector opens a connector to the shared in-process broker
+func (d BusDriver) OpenConnector() (driver.Connector, error) {
+	return newConnector(defaultBroker), nil
+}
+
+var (
+	brokersMu sync.Mutex
+	brokers   = make(map[string]*broker)
+)
+
+// OpenConnectorDSN opens a connector to the broker named by the DSN, memory://name,
+// creating it if needed. An empty DSN, or no name, is the shared broker.
+func (d BusDriver) OpenConnectorDSN(dsn string) (driver.Connector, error) {
+	if dsn == "" {
+		return d.OpenConnector()
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("memory: invalid dsn: %w", err)
+	}
+	if u.Scheme != "memory" {
+		return nil, fmt.Errorf("memory: dsn scheme must be memory, got %q", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return d.OpenConnector()
+	}
+
+	brokersMu.Lock()
+	defer brokersMu.Unlock()
+	b, ok := brokers[u.Host]
+	if !ok {
+		b = newBroker()
+		brokers[u.Host] = b
+	}
+	return newConnector(b), nil
+}
+
+func init() {
+	bus.Register("memory", &BusDriver{})
+}
@@ -0,0 +1,515 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// queueSize is the number of messages a subscription holds waiting for a
+	// worker. Core NATS messages beyond that wait in the client, up to its pending
+	// limits, after which the server drops them as it would for any slow consumer.
+	queueSize = 1024
+
+	// drainPoll is how often we look to see if a core subscription has finished
+	// draining.
+	drainPoll = 10 * time.Millisecond
+
+	// fetchTimeout is how long a JetStream fetch waits for messages before asking
+	// again.
+	fetchTimeout = 5 * time.Second
+
+	// flushTimeout bounds waiting for the server to receive a core NATS push, if
+	// the context doesn't.
+	flushTimeout = 10 * time.Second
+)
+
+type conn struct {
+	cfg       config
+	connector *connector
+
+	consumeCtx  context.Context
+	stopConsume context.CancelFunc
+}
+
+// queue holds the messages of a subscription waiting for a worker.
+type queue struct {
+	jobs chan job
+
+	// mu guards closed, held for reading while retrying a core message so nothing
+	// is queued after the queue has been drained
+	mu     sync.RWMutex
+	closed bool
+}
+
+// job is a message waiting for a worker, along with the topics of the exchange it
+// was received on.
+type job struct {
+	msg      *nats.Msg
+	exchange string
+	topics   []driver.Topic
+	attempt  int
+}
+
+func (c *conn) Push(ctx context.Context, topic driver.Topic, m driver.Message) error {
+	return c.PushEnvelope(ctx, topic, driver.Envelope{Timestamp: time.Now()}, m)
+}
+
+func (c *conn) PushEnvelope(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message) error {
+	if env.RoutingKey == "" {
+		env.RoutingKey = topic.Name
+	}
+
+	body, err := topic.Codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+	msg := c.message(topic, env, body)
+
+	if c.cfg.JetStream {
+		if _, err := c.connector.ensureStream(topic.Exchange); err != nil {
+			return err
+		}
+		// the stream acknowledges once it has stored the message
+		if _, err := c.connector.js.PublishMsg(msg, nats.Context(ctx)); err != nil {
+			return err
+		}
+		c.connector.metrics.Add(driver.MetricConfirmed, topic.Name)
+		return nil
+	}
+
+	if err := c.connector.nc.PublishMsg(msg); err != nil {
+		return err
+	}
+	// core NATS has no acknowledgement, the best we can do is know the server
+	// has received it
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flushTimeout)
+		defer cancel()
+	}
+	return c.connector.nc.FlushWithContext(ctx)
+}
+
+// Request implements driver.ConnRequest, the reply comes back over core NATS to
+// an inbox of our own, whether or not the request went through JetStream.
+func (c *conn) Request(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message) (driver.Delivery, error) {
+	inbox := nats.NewInbox()
+	sub, err := c.connector.nc.SubscribeSync(inbox)
+	if err != nil {
+		return driver.Delivery{}, fmt.Errorf("unable to subscribe to reply inbox: %w", err)
+	}
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			c.connector.log().Warn("nats unable to unsubscribe", "subject", inbox, "error", err)
+		}
+	}()
+
+	env.ReplyTo = inbox
+	if err := c.PushEnvelope(ctx, topic, env, m); err != nil {
+		return driver.Delivery{}, err
+	}
+	driver.RequestSent(ctx)
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return driver.Delivery{}, err
+		}
+		// the inbox is ours alone, but anything could be published to it
+		if msg.Header.Get(headerCausationID) != env.ID {
+			continue
+		}
+		return delivery(msg, topic, msg.Header.Get(headerRoutingKey), 1), nil
+	}
+}
+
+// Reply implements driver.ConnRequest. If nobody is listening on the inbox the
+// reply is dropped by the server.
+func (c *conn) Reply(ctx context.Context, replyTo string, reply driver.Delivery) error {
+	msg := nats.NewMsg(replyTo)
+	msg.Data = reply.Body
+	setHeaders(msg, reply.Envelope, reply.ContentType)
+
+	if err := c.connector.nc.PublishMsg(msg); err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flushTimeout)
+		defer cancel()
+	}
+	return c.connector.nc.FlushWithContext(ctx)
+}
+
+func (c *conn) Subscribe(ctx context.Context, topics []driver.Topic) error {
+	return c.SubscribeWithOptions(ctx, topics, driver.SubscribeOptions{})
+}
+
+func (c *conn) SubscribeWithOptions(ctx context.Context, topics []driver.Topic, opts driver.SubscribeOptions) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = c.cfg.Workers
+	}
+
+	q := &queue{jobs: make(chan job, queueSize)}
+
+	// topics with a concurrency of their own are consumed in lanes, so they don't
+	// hold up the workers
+	lanes := driver.NewLanes(topics, workers)
+
+	// stop any fetching already started if a later subscription fails
+	var fetchers sync.WaitGroup
+	defer fetchers.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// a subscription per exchange, topics sharing an exchange are told apart by
+	// routing key the same as a rabbit queue bound to it
+	var subs []*nats.Subscription
+	defer func() {
+		for _, sub := range subs {
+			if !sub.IsValid() {
+				// drained already
+				continue
+			}
+			if err := sub.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+				c.connector.log().Warn("nats unable to unsubscribe", "subject", sub.Subject, "error", err)
+			}
+		}
+	}()
+
+	for _, exchange := range exchanges(topics) {
+		group := exchangeTopics(topics, exchange)
+
+		if c.cfg.JetStream {
+			sub, err := c.pullSubscribe(exchange, group, workers+lanes.Held())
+			if err != nil {
+				return err
+			}
+			subs = append(subs, sub)
+
+			fetchers.Add(1)
+			go func(exchange string) {
+				defer fetchers.Done()
+				c.fetch(ctx, sub, exchange, group, workers, q.jobs)
+			}(exchange)
+			continue
+		}
+
+		exchange := exchange
+		sub, err := c.connector.nc.QueueSubscribe(
+			c.filter(exchange, group),
+			c.queueGroup(),
+			func(msg *nats.Msg) {
+				// waiting on a full queue holds up the subscription, leaving the
+				// client to hold on to what comes next
+				select {
+				case q.jobs <- job{msg: msg, exchange: exchange, topics: group, attempt: 1}:
+				case <-c.consumeCtx.Done():
+					c.connector.log().Error("nats connection closed, dropping message", "subject", msg.Subject)
+				}
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("unable to subscribe to exchange %q: %w", exchange, err)
+		}
+		subs = append(subs, sub)
+	}
+
+	// the workers keep consuming after the subscriptions are stopped, until the
+	// queue has been drained
+	drain := make(chan struct{})
+	var inflight sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			for {
+				select {
+				case j := <-q.jobs:
+					c.handle(q, j, lanes)
+				case <-drain:
+					c.drain(q, lanes)
+					return
+				}
+			}
+		}()
+	}
+
+	<-ctx.Done()
+
+	// stop taking on anything new. Core NATS has nothing to hand messages back
+	// to, so its subscriptions are drained and what they queued is consumed
+	// before returning, as Unsubscribe waits for. JetStream fetching stops,
+	// handing back whatever it hadn't queued.
+	if !c.cfg.JetStream {
+		c.drainSubs(subs)
+	}
+	fetchers.Wait()
+
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	close(drain)
+	inflight.Wait()
+	lanes.Close()
+	return nil
+}
+
+// drainSubs removes our interest in the subscriptions' subjects, waiting until
+// the messages the client already has for them are queued, or the connection is
+// closed.
+func (c *conn) drainSubs(subs []*nats.Subscription) {
+	for _, sub := range subs {
+		if err := sub.Drain(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			c.connector.log().Warn("nats unable to drain subscription", "subject", sub.Subject, "error", err)
+		}
+	}
+	for _, sub := range subs {
+		// the client gives up draining after its drain timeout, so this ends
+		for sub.IsValid() {
+			select {
+			case <-c.consumeCtx.Done():
+				return
+			case <-time.After(drainPoll):
+			}
+		}
+	}
+}
+
+// drain consumes what is left in the queue. It is only called once the
+// subscriptions are stopped and the queue is closed, so nothing more is queued.
+func (c *conn) drain(q *queue, lanes *driver.Lanes) {
+	for {
+		select {
+		case j := <-q.jobs:
+			c.handle(q, j, lanes)
+		default:
+			return
+		}
+	}
+}
+
+// pullSubscribe creates the durable consumer for the exchange's topics, if it
+// doesn't exist, and binds a pull subscription to it. Binding means the consumer
+// outlives the subscription, so messages pushed while we are away are kept.
+// No more than maxAckPending messages are sent to us unacknowledged.
+func (c *conn) pullSubscribe(exchange string, topics []driver.Topic, maxAckPending int) (*nats.Subscription, error) {
+	stream, err := c.connector.ensureStream(exchange)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := c.filter(exchange, topics)
+	durable := sanitize(c.queueGroup() + "_" + subject)
+
+	_, err = c.connector.js.ConsumerInfo(stream, durable)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		_, err = c.connector.js.AddConsumer(stream, &nats.ConsumerConfig{
+			Durable:       durable,
+			DeliverPolicy: nats.DeliverAllPolicy,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       c.cfg.AckWait,
+			MaxAckPending: maxAckPending,
+			FilterSubject: subject,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create consumer %s on stream %s: %w", durable, stream, err)
+	}
+
+	sub, err := c.connector.js.PullSubscribe(subject, durable, nats.Bind(stream, durable))
+	if err != nil {
+		return nil, fmt.Errorf("unable to subscribe to consumer %s: %w", durable, err)
+	}
+	return sub, nil
+}
+
+// fetch pulls messages for the workers until ctx is done.
+func (c *conn) fetch(ctx context.Context, sub *nats.Subscription, exchange string, topics []driver.Topic, batch int, queue chan<- job) {
+	for attempt := 1; ; {
+		fctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+		msgs, err := sub.Fetch(batch, nats.Context(fctx))
+		cancel()
+
+		for i, msg := range msgs {
+			select {
+			case queue <- job{msg: msg, exchange: exchange, topics: topics}:
+			case <-ctx.Done():
+				for _, msg := range msgs[i:] {
+					_ = msg.Nak()
+				}
+				return
+			}
+		}
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil, errors.Is(err, context.DeadlineExceeded), errors.Is(err, nats.ErrTimeout):
+			attempt = 1
+			continue
+		}
+
+		c.connector.log().Warn("nats unable to fetch", "subject", sub.Subject, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(driver.Jitter(driver.Backoff(attempt, c.cfg.ReconnectDelay, c.cfg.ReconnectMaxDelay))):
+		}
+		attempt++
+	}
+}
+
+// handle passes a message to the matching topic consumer, in the topic's lane if
+// it has one.
+func (c *conn) handle(q *queue, j job, lanes *driver.Lanes) {
+	routingKey := c.routingKey(j.msg, j.exchange)
+
+	attempt := j.attempt
+	if c.cfg.JetStream {
+		if meta, err := j.msg.Metadata(); err == nil {
+			attempt = int(meta.NumDelivered)
+		}
+	}
+
+	t, ok := driver.MatchTopic(j.topics, routingKey)
+	if !ok {
+		// the subscription covers the whole exchange when the topics can't be
+		// put as a single subject, this one is for none of ours
+		if c.cfg.JetStream {
+			_ = j.msg.Ack()
+		}
+		return
+	}
+
+	lanes.Do(t, func() {
+		c.consume(q, j, t, routingKey, attempt)
+	})
+}
+
+// consume passes a message to the topic's consumer, acknowledging it on success
+// and retrying it after the topic's backoff on failure.
+func (c *conn) consume(q *queue, j job, t driver.Topic, routingKey string, attempt int) {
+	d := delivery(j.msg, t, routingKey, attempt)
+	err := t.Consumer(c.consumeCtx, d)
+	if err == nil {
+		if c.cfg.JetStream {
+			if err := j.msg.Ack(); err != nil {
+				c.connector.log().Warn("nats acknowledgement unsuccessful", "message_id", d.Envelope.ID, "error", err)
+			}
+		}
+		return
+	}
+
+	c.connector.log().Warn("consumer had an issue processing an event message",
+		"topic", t.Name,
+		"routing_key", routingKey,
+		"message_id", d.Envelope.ID,
+		"attempt", attempt,
+		"payload", d.Body,
+		"error", err,
+	)
+
+	policy := t.RetryPolicy()
+	if attempt >= policy.MaxAttempts {
+		c.connector.log().Error("message failed too many times, dropping",
+			"topic", t.Name,
+			"routing_key", routingKey,
+			"message_id", d.Envelope.ID,
+			"attempt", attempt,
+		)
+		c.connector.metrics.Add(driver.MetricDeadLettered, t.Name)
+		if c.cfg.JetStream {
+			_ = j.msg.Term()
+		}
+		return
+	}
+	c.connector.metrics.Add(driver.MetricRequeued, t.Name)
+
+	if c.cfg.JetStream {
+		if err := j.msg.NakWithDelay(policy.Backoff(attempt)); err != nil {
+			c.connector.log().Warn("nats negative acknowledgement unsuccessful", "message_id", d.Envelope.ID, "error", err)
+		}
+		return
+	}
+
+	// core NATS has no redelivery, so retry it ourselves
+	j.attempt++
+	time.AfterFunc(policy.Backoff(attempt), func() {
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+
+		if q.closed {
+			c.connector.log().Warn("nats subscription stopped, dropping retry of message",
+				"topic", t.Name,
+				"message_id", d.Envelope.ID,
+			)
+			return
+		}
+
+		select {
+		case q.jobs <- j:
+		default:
+			c.connector.log().Error("nats subscription queue full, dropping retry of message",
+				"topic", t.Name,
+				"message_id", d.Envelope.ID,
+			)
+		}
+	})
+}
+
+// filter is the subject subscribed to for an exchange's topics. NATS subjects
+// only have one filter, and no equivalent of # in the middle of a pattern, so
+// anything other than a single topic without # gets the whole exchange.
+func (c *conn) filter(exchange string, topics []driver.Topic) string {
+	if len(topics) == 1 && !strings.Contains(topics[0].Name, "#") {
+		return c.connector.subject(exchange, topics[0].Name)
+	}
+	return c.connector.subject(exchange, ">")
+}
+
+// queueGroup is the queue group of our subscriptions, shared by every instance
+// of the service.
+func (c *conn) queueGroup() string {
+	return c.cfg.Prefix + c.cfg.Name
+}
+
+// Close cancels the context of any consumers still running. The connection is
+// shared and owned by the connector, so is left open.
+func (c *conn) Close() error {
+	c.stopConsume()
+	return nil
+}
+
+// exchanges returns the distinct exchanges of the topics, in order.
+func exchanges(topics []driver.Topic) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, t := range topics {
+		if !seen[t.Exchange] {
+			seen[t.Exchange] = true
+			ret = append(ret, t.Exchange)
+		}
+	}
+	return ret
+}
+
+func exchangeTopics(topics []driver.Topic, exchange string) []driver.Topic {
+	var ret []driver.Topic
+	for _, t := range topics {
+		if t.Exchange == exchange {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
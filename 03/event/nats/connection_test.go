@@ -0,0 +1,407 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+type message struct {
+	N int
+}
+
+var movieRelease = bus.NewTopic[message]("movie.release", "movie")
+
+// runServer starts a NATS server in-process, with JetStream if asked, shut down
+// when the test finishes.
+func runServer(t *testing.T, jetStream bool) *server.Server {
+	t.Helper()
+
+	opts := &server.Options{
+		Host:   "127.0.0.1",
+		Port:   -1, // any free port
+		NoLog:  true,
+		NoSigs: true,
+	}
+	if jetStream {
+		opts.JetStream = true
+		opts.StoreDir = t.TempDir()
+	}
+
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// open opens a bus on the server, the query adding to the DSN.
+func open(t *testing.T, s *server.Server, query string) *bus.Bus {
+	t.Helper()
+
+	b, err := bus.Open("nats", fmt.Sprintf("%s?name=svc&%s", s.ClientURL(), query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// subscribe subscribes in the background, returning once the server has the
+// subscription. It is unsubscribed when the test finishes.
+func subscribe(t *testing.T, s *server.Server, b *bus.Bus, opts driver.SubscribeOptions) {
+	t.Helper()
+
+	before := s.NumSubscriptions()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.SubscribeWithOptions(opts)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("subscribe: %v", err)
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.NumSubscriptions() <= before {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the subscription")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitFor fails the test if ch isn't closed in time.
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// metrics counts the bus' metrics.
+type metrics struct {
+	mu     sync.Mutex
+	counts map[driver.Metric]int
+}
+
+func (m *metrics) Add(metric driver.Metric, driverName, topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[driver.Metric]int)
+	}
+	m.counts[metric]++
+}
+
+func (m *metrics) Observe(driver.Timing, string, string, time.Duration) {}
+
+func (m *metrics) count(metric driver.Metric) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[metric]
+}
+
+func TestCoreDelivery(t *testing.T) {
+	s := runServer(t, false)
+	b := open(t, s, "")
+
+	var (
+		mu   sync.Mutex
+		got  = make(map[int]bool)
+		done = make(chan struct{})
+	)
+	err := bus.HandleEnvelope(b, movieRelease, func(ctx context.Context, env bus.Envelope, msg message) error {
+		if env.Topic != "movie.release" || env.RoutingKey != "movie.release" || env.ID == "" || env.Tenant != "acme" {
+			t.Errorf("unexpected envelope %+v", env)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		got[msg.N] = true
+		if len(got) == 3 {
+			close(done)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, s, b, driver.SubscribeOptions{})
+
+	for i := 1; i <= 3; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}, bus.WithTenant("acme")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, done, "messages")
+}
+
+func TestCoreWildcard(t *testing.T) {
+	s := runServer(t, false)
+	b := open(t, s, "")
+
+	topic := bus.NewTopic[message]("movie.release.*", "movie")
+	keys := make(chan string, 2)
+	err := bus.HandleEnvelope(b, topic, func(ctx context.Context, env bus.Envelope, msg message) error {
+		keys <- env.RoutingKey
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, s, b, driver.SubscribeOptions{})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}, bus.WithRoutingKey("movie.release.drama")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(context.Background(), b, topic, message{}, bus.WithRoutingKey("movie.rating")); err == nil {
+		t.Fatal("pushed a routing key the topic doesn't match")
+	}
+
+	select {
+	case key := <-keys:
+		if key != "movie.release.drama" {
+			t.Fatalf("consumed %q", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+}
+
+func TestCoreRetry(t *testing.T) {
+	s := runServer(t, false)
+	b := open(t, s, "")
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond}
+
+	var attempts int32
+	done := make(chan struct{})
+	err := bus.HandleEnvelope(b, topic, func(ctx context.Context, env bus.Envelope, msg message) error {
+		if n := atomic.AddInt32(&attempts, 1); int(n) != env.Attempt {
+			t.Errorf("attempt %d, want %d", env.Attempt, n)
+		}
+		if env.Attempt < 3 {
+			return errors.New("not yet")
+		}
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, s, b, driver.SubscribeOptions{Workers: 1})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, done, "the third attempt")
+}
+
+// Core NATS messages have nowhere to go back to, so those the subscription has
+// when unsubscribing are consumed first, even beyond a full queue.
+func TestCoreUnsubscribeDrains(t *testing.T) {
+	s := runServer(t, false)
+	b := open(t, s, "")
+
+	release := make(chan struct{})
+	var consumed int32
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		<-release
+		atomic.AddInt32(&consumed, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, s, b, driver.SubscribeOptions{Workers: 1})
+
+	// one with the worker, a full queue and more waiting in the client
+	const n = queueSize + 100
+	for i := 0; i < n; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		defer close(unsubscribed)
+		if err := b.Unsubscribe(context.Background()); err != nil {
+			t.Errorf("unsubscribe: %v", err)
+		}
+	}()
+
+	select {
+	case <-unsubscribed:
+		t.Fatal("unsubscribe returned with messages still being consumed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	waitFor(t, unsubscribed, "unsubscribe")
+
+	if got := atomic.LoadInt32(&consumed); got != n {
+		t.Fatalf("consumed %d messages, want %d", got, n)
+	}
+}
+
+func TestJetStreamAck(t *testing.T) {
+	s := runServer(t, true)
+	b := open(t, s, "jetstream=true&ack_wait=200ms")
+
+	var consumed int32
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		atomic.AddInt32(&consumed, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pushed before subscribing, the stream keeps it for the durable consumer
+	if err := bus.Publish(context.Background(), b, movieRelease, message{}); err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, s, b, driver.SubscribeOptions{})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&consumed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// acknowledged, so it isn't sent again once the ack wait is up
+	time.Sleep(500 * time.Millisecond)
+	if n := atomic.LoadInt32(&consumed); n != 1 {
+		t.Fatalf("consumed %d times, want 1", n)
+	}
+}
+
+func TestJetStreamNakRetry(t *testing.T) {
+	s := runServer(t, true)
+	b := open(t, s, "jetstream=true")
+	m := &metrics{}
+	b.SetMetrics(m)
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 3, Delay: 10 * time.Millisecond}
+
+	var attempts []int
+	done := make(chan struct{})
+	err := bus.HandleEnvelope(b, topic, func(ctx context.Context, env bus.Envelope, msg message) error {
+		attempts = append(attempts, env.Attempt)
+		if env.Attempt < 3 {
+			return errors.New("not yet")
+		}
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, s, b, driver.SubscribeOptions{Workers: 1})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, done, "the third attempt")
+
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[1] != 2 || attempts[2] != 3 {
+		t.Fatalf("attempts %v, want [1 2 3]", attempts)
+	}
+	if n := m.count(driver.MetricRequeued); n != 2 {
+		t.Fatalf("requeued %d times, want 2", n)
+	}
+	if n := m.count(driver.MetricConfirmed); n != 1 {
+		t.Fatalf("confirmed %d pushes, want 1", n)
+	}
+}
+
+func TestJetStreamDeadLetter(t *testing.T) {
+	s := runServer(t, true)
+	b := open(t, s, "jetstream=true&ack_wait=200ms")
+	m := &metrics{}
+	b.SetMetrics(m)
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 2, Delay: 10 * time.Millisecond}
+
+	var attempts int32
+	err := bus.Handle(b, topic, func(ctx context.Context, msg message) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("never")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, s, b, driver.SubscribeOptions{Workers: 1})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for m.count(driver.MetricDeadLettered) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the message to be dead lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// terminated, so the server doesn't send it again, not even after the ack
+	// wait
+	time.Sleep(500 * time.Millisecond)
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("consumed %d times, want 2", n)
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	s := runServer(t, true)
+	b := open(t, s, "jetstream=true")
+
+	err := bus.Respond(b, movieRelease, func(ctx context.Context, req message) (message, error) {
+		return message{N: req.N * 2}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, s, b, driver.SubscribeOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := bus.Request[message, message](ctx, b, movieRelease, message{N: 21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.N != 42 {
+		t.Fatalf("got %d, want 42", resp.N)
+	}
+}
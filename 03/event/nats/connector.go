@@ -0,0 +1,195 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	"github.com/nats-io/nats.go"
+)
+
+// connector holds a single NATS connection shared by every driver.Conn handed
+// out, the client multiplexes subscriptions over it and reconnects by itself.
+type connector struct {
+	cfg config
+
+	nc *nats.Conn
+	js nats.JetStreamContext
+
+	mu      sync.Mutex
+	streams map[string]bool // streams known to exist
+	onState func(driver.ConnEvent)
+	metrics driver.Metrics
+	logger  driver.Logger
+}
+
+func newConnector(cfg config) *connector {
+	return &connector{
+		cfg:     cfg,
+		streams: make(map[string]bool),
+		metrics: driver.NopMetrics{},
+		logger:  driver.StdLogger{},
+	}
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.nc.IsClosed() {
+		return nil, nats.ErrConnectionClosed
+	}
+	consumeCtx, stop := driver.ConsumeContext(ctx)
+	return &conn{cfg: c.cfg, connector: c, consumeCtx: consumeCtx, stopConsume: stop}, nil
+}
+
+// open connects to the server, so a bad configuration is reported straight away.
+// After that the client reconnects by itself, forever, with backoff.
+func (c *connector) open() error {
+	opts := []nats.Option{
+		nats.Name(c.cfg.Name),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(func(attempt int) time.Duration {
+			c.notify(driver.ConnEvent{State: driver.StateReconnecting, Attempt: attempt})
+			return driver.Jitter(driver.Backoff(attempt, c.cfg.ReconnectDelay, c.cfg.ReconnectMaxDelay))
+		}),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if nc.IsClosed() {
+				// closed by us, nothing to do
+				return
+			}
+			c.log().Warn("nats connection lost", "error", err)
+			c.notify(driver.ConnEvent{State: driver.StateDisconnected, Err: err})
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			c.notify(driver.ConnEvent{State: driver.StateConnected})
+		}),
+	}
+	if c.cfg.Creds != "" {
+		opts = append(opts, nats.UserCredentials(c.cfg.Creds))
+	}
+	if c.cfg.CACertFile != "" {
+		opts = append(opts, nats.RootCAs(c.cfg.CACertFile))
+	}
+	if c.cfg.CertFile != "" {
+		opts = append(opts, nats.ClientCert(c.cfg.CertFile, c.cfg.KeyFile))
+	}
+
+	nc, err := nats.Connect(c.cfg.URL, opts...)
+	if err != nil {
+		return fmt.Errorf("unable to connect to nats: %w", err)
+	}
+	c.nc = nc
+
+	if c.cfg.JetStream {
+		c.js, err = nc.JetStream()
+		if err != nil {
+			nc.Close()
+			return fmt.Errorf("unable to use jetstream: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// subject is the NATS subject for a routing key on an exchange.
+func (c *connector) subject(exchange, key string) string {
+	return c.cfg.Prefix + exchange + "." + key
+}
+
+// streamName is the name of the stream holding an exchange's messages. Stream
+// names can't have dots or wildcards in them.
+func (c *connector) streamName(exchange string) string {
+	return sanitize(c.cfg.Prefix + exchange)
+}
+
+// ensureStream creates the stream for an exchange if it doesn't exist yet.
+func (c *connector) ensureStream(exchange string) (string, error) {
+	name := c.streamName(exchange)
+
+	c.mu.Lock()
+	known := c.streams[name]
+	c.mu.Unlock()
+	if known {
+		return name, nil
+	}
+
+	_, err := c.js.StreamInfo(name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = c.js.AddStream(&nats.StreamConfig{
+			Name:     name,
+			Subjects: []string{c.subject(exchange, ">")},
+			Storage:  nats.FileStorage,
+			Replicas: c.cfg.Replicas,
+		})
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to create stream %s: %w", name, err)
+	}
+
+	c.mu.Lock()
+	c.streams[name] = true
+	c.mu.Unlock()
+	return name, nil
+}
+
+// SetMetrics implements driver.ConnectorMetrics.
+func (c *connector) SetMetrics(m driver.Metrics) {
+	c.metrics = m
+}
+
+// SetLogger implements driver.ConnectorLogger.
+func (c *connector) SetLogger(l driver.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logger = l
+}
+
+// log returns the logger, which may be set while the client is reconnecting.
+func (c *connector) log() driver.Logger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logger
+}
+
+// NotifyState implements driver.ConnStateNotifier.
+func (c *connector) NotifyState(f func(driver.ConnEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onState = f
+}
+
+func (c *connector) notify(e driver.ConnEvent) {
+	c.mu.Lock()
+	f := c.onState
+	c.mu.Unlock()
+
+	if f != nil {
+		f(e)
+	}
+}
+
+// Close drains the shared connection, letting anything published be flushed,
+// and closes it.
+func (c *connector) Close() error {
+	if c.nc.IsClosed() {
+		return nil
+	}
+	return c.nc.Drain()
+}
+
+func (c *connector) Driver() driver.Driver {
+	return BusDriver{}
+}
+
+// sanitize replaces everything NATS doesn't allow in stream and consumer names.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '#':
+			return '_'
+		}
+		return r
+	}, name)
+}
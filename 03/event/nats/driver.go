@@ -0,0 +1,56 @@
+// Package nats provides the implementation of the bus/driver interface for NATS:
+// https://docs.nats.io/
+//
+// A topic's exchange and routing key make up the NATS subject, exchange.key, so
+// a topic named movie.release.* on the movie exchange is subscribed to as the
+// subject movie.movie.release.*. Subscriptions use a queue group named after the
+// service, so running more than one instance shares the messages between them the
+// same as a rabbit queue.
+//
+// Core NATS is at most once, a message pushed while nobody is subscribed is gone.
+// With jetstream=true in the DSN messages are stored in a stream per exchange and
+// consumed through a durable consumer, acknowledged once the consumer succeeds.
+//
+// NATS can't hold on to messages for later, so delayed pushes are left to the
+// bus' scheduler, see bus.SetScheduler.
+package nats
+
+import (
+	"fmt"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+type BusDriver struct{}
+
+// OpenConnector always fails, there is no default service name, see
+// OpenConnectorDSN.
+func (d BusDriver) OpenConnector() (driver.Connector, error) {
+	return d.OpenConnectorDSN("")
+}
+
+// OpenConnectorDSN opens a connection to NATS configured by dsn, see ParseDSN for
+// its format.
+func (d BusDriver) OpenConnectorDSN(dsn string) (driver.Connector, error) {
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("bus name variable is not set, each service needs this set in order to join a queue group")
+	}
+
+	conn := newConnector(cfg)
+
+	// create a connection to ensure it works
+	if err := conn.open(); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func init() {
+	bus.Register("nats", &BusDriver{})
+}
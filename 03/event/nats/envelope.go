@@ -0,0 +1,110 @@
+package nats
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	headerContentType   = "Content-Type"
+	headerCorrelationID = "X-Correlation-Id"
+	headerCausationID   = "X-Causation-Id"
+	headerTenant        = "X-Tenant"
+	headerTimestamp     = "X-Timestamp"
+	// headerRoutingKey holds the routing key, the subject has the prefix and
+	// exchange in front of it.
+	headerRoutingKey = "X-Routing-Key"
+	// headerReplyTo holds the inbox a request's reply goes to. The message's own
+	// reply subject is JetStream's for acknowledging.
+	headerReplyTo = "X-Reply-To"
+)
+
+// internalHeaders are used by the driver itself and not passed on to consumers.
+var internalHeaders = map[string]bool{
+	nats.MsgIdHdr:       true,
+	headerContentType:   true,
+	headerCorrelationID: true,
+	headerCausationID:   true,
+	headerTenant:        true,
+	headerTimestamp:     true,
+	headerRoutingKey:    true,
+	headerReplyTo:       true,
+}
+
+// message builds the NATS message for an envelope.
+func (c *conn) message(topic driver.Topic, env driver.Envelope, body []byte) *nats.Msg {
+	msg := nats.NewMsg(c.connector.subject(topic.Exchange, env.RoutingKey))
+	msg.Data = body
+	setHeaders(msg, env, topic.Codec.ContentType())
+	return msg
+}
+
+// setHeaders carries the envelope, and the body's content type, in the message's
+// headers.
+func setHeaders(msg *nats.Msg, env driver.Envelope, contentType string) {
+	for k, v := range env.Headers {
+		msg.Header.Set(k, v)
+	}
+	if env.ID != "" {
+		// JetStream drops duplicates of a message ID within its window
+		msg.Header.Set(nats.MsgIdHdr, env.ID)
+	}
+	msg.Header.Set(headerContentType, contentType)
+	msg.Header.Set(headerRoutingKey, env.RoutingKey)
+	msg.Header.Set(headerTimestamp, env.Timestamp.Format(time.RFC3339Nano))
+	if env.CorrelationID != "" {
+		msg.Header.Set(headerCorrelationID, env.CorrelationID)
+	}
+	if env.CausationID != "" {
+		msg.Header.Set(headerCausationID, env.CausationID)
+	}
+	if env.Tenant != "" {
+		msg.Header.Set(headerTenant, env.Tenant)
+	}
+	if env.ReplyTo != "" {
+		msg.Header.Set(headerReplyTo, env.ReplyTo)
+	}
+}
+
+// routingKey returns the routing key the message was pushed with.
+func (c *conn) routingKey(msg *nats.Msg, exchange string) string {
+	if key := msg.Header.Get(headerRoutingKey); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(msg.Subject, c.connector.subject(exchange, ""))
+}
+
+// delivery builds what is passed to the topic consumer for a message.
+func delivery(msg *nats.Msg, t driver.Topic, routingKey string, attempt int) driver.Delivery {
+	env := driver.Envelope{
+		ID:            msg.Header.Get(nats.MsgIdHdr),
+		CorrelationID: msg.Header.Get(headerCorrelationID),
+		CausationID:   msg.Header.Get(headerCausationID),
+		Tenant:        msg.Header.Get(headerTenant),
+		Redelivered:   attempt > 1,
+		Attempt:       attempt,
+		Topic:         t.Name,
+		RoutingKey:    routingKey,
+		ReplyTo:       msg.Header.Get(headerReplyTo),
+	}
+	env.Timestamp, _ = time.Parse(time.RFC3339Nano, msg.Header.Get(headerTimestamp))
+
+	for k := range msg.Header {
+		if internalHeaders[k] {
+			continue
+		}
+		if env.Headers == nil {
+			env.Headers = make(map[string]string)
+		}
+		env.Headers[k] = msg.Header.Get(k)
+	}
+
+	return driver.Delivery{
+		Envelope:    env,
+		ContentType: msg.Header.Get(headerContentType),
+		Body:        msg.Data,
+	}
+}
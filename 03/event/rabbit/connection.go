@@ -2,12 +2,11 @@ package rabbit
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"reflect"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
@@ -15,108 +14,283 @@ import (
 )
 
 type rabbit struct {
-	cfg  config
-	conn *amqp.Connection
-	ch   *amqp.Channel
-}
+	cfg       config
+	connector *connector
+
+	// mu guards swapping the channel when a subscription is resumed
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	ch     *amqp.Channel
+	closed bool
 
-type route struct {
-	resource string
-	action   string
+	consumeCtx  context.Context
+	stopConsume context.CancelFunc
 }
 
 func (r *rabbit) Push(ctx context.Context, topic driver.Topic, m driver.Message) error {
-	defer r.ch.Close()
-	defer r.conn.Close()
-	// assert it has the right type
-	messageType := reflect.TypeOf(m)
-	topicType := reflect.TypeOf(topic.Type)
-
-	if reflect.TypeOf(m) != reflect.TypeOf(topic.Type) {
-		return fmt.Errorf("message type: %s does not match topic type: %s", messageType, topicType)
+	return r.PushEnvelope(ctx, topic, driver.Envelope{Timestamp: time.Now()}, m)
+}
+
+func (r *rabbit) PushEnvelope(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message) error {
+	if env.RoutingKey == "" {
+		env.RoutingKey = topic.Name
 	}
+	return r.publish(ctx, fmt.Sprintf("%s%s", r.cfg.Prefix, topic.Exchange), topic, env, m)
+}
 
-	confirms := make(chan amqp.Confirmation)
-	errs := make(chan error, 1)
+// publish publishes the message to the exchange, with the routing key for its
+// envelope, and waits for the broker to confirm it.
+func (r *rabbit) publish(ctx context.Context, exchange string, topic driver.Topic, env driver.Envelope, m driver.Message) error {
+	// the channel has been closed underneath us, nothing has been sent yet so
+	// the bus is safe to retry on another one
+	if r.ch.IsClosed() {
+		return driver.ErrBadConn
+	}
 
-	err := r.ch.Confirm(false)
+	body, err := topic.Codec.Marshal(m)
 	if err != nil {
-		close(confirms)
-		return fmt.Errorf("channel could not be put into confirm mode: %w", err)
+		return err
 	}
 
-	r.ch.NotifyPublish(confirms)
-	// TODO: this channel is essential and needs to be improved so unacknowledged messages are handled better
-	// ideally through the error return on the push
-	go func() {
-		for confirm := range confirms {
-			if confirm.Ack {
-				// code when messages is confirmed
-				errs <- nil
-			} else {
-				// code when messages is nack-ed
-				log.Printf("Nacked")
-				errs <- fmt.Errorf("unable to acknowledge the message on rabbit mq")
-			}
+	confirm, err := r.ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,          // exchange
+		r.routingKey(env), // routing key
+		true,              // mandatory
+		false,             // immediate
+		amqp.Publishing{
+			Headers:       headers(env),
+			MessageId:     env.ID,
+			CorrelationId: env.CorrelationID,
+			Timestamp:     env.Timestamp,
+			ReplyTo:       env.ReplyTo,
+			ContentType:   topic.Codec.ContentType(),
+			Body:          body,
+			DeliveryMode:  2, // persistent
+		})
+	if errors.Is(err, amqp.ErrClosed) {
+		return driver.ErrBadConn
+	}
+	if err != nil {
+		return err
+	}
+
+	// the channel is in confirm mode, so wait for the broker to ack or nack
+	if !confirm.Wait() {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("confirmation failed: %w", err)
 		}
-	}()
+		r.connector.log().Warn("rabbit nacked message", "topic", topic.Name, "message_id", env.ID)
+		r.connector.metrics.Add(driver.MetricNacked, topic.Name)
+		return fmt.Errorf("confirmation failed: unable to acknowledge the message on rabbit mq")
+	}
+
+	r.connector.metrics.Add(driver.MetricConfirmed, topic.Name)
+	return nil
+}
+
+// Request implements driver.ConnRequest using direct reply-to, so there is no
+// queue to declare for replies, they come straight back on our channel. The
+// pool lends a connection to one caller at a time, so there is only ever one
+// reply consumer on the channel as rabbit requires.
+func (r *rabbit) Request(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message) (driver.Delivery, error) {
+	if r.ch.IsClosed() {
+		return driver.Delivery{}, driver.ErrBadConn
+	}
 
-	body, err := json.Marshal(m)
+	// we have to be consuming the pseudo-queue before publishing to it
+	tag := consumerTag(r.cfg.Name)
+	replies, err := r.ch.Consume(
+		directReplyTo, // queue
+		tag,           // consumer
+		true,          // auto ack, it has to be
+		true,          // exclusive
+		false,         // noLocal
+		false,         // noWait
+		nil,           // args
+	)
+	if errors.Is(err, amqp.ErrClosed) {
+		return driver.Delivery{}, driver.ErrBadConn
+	}
 	if err != nil {
-		return err
+		return driver.Delivery{}, fmt.Errorf("unable to consume replies: %w", err)
 	}
+	defer r.cancel(tag)
 
-	err = r.ch.Publish(
-		fmt.Sprintf("%s%s", os.Getenv("BUS_PREFIX"), topic.Exchange), // exchange
-		fmt.Sprintf("%s%s", topic.Name, "*"),                         // routing key
-		true,                                                         // mandatory
-		false,                                                        // immediate
+	env.ReplyTo = directReplyTo
+	if err := r.PushEnvelope(ctx, topic, env, m); err != nil {
+		return driver.Delivery{}, err
+	}
+	driver.RequestSent(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return driver.Delivery{}, ctx.Err()
+		case msg, ok := <-replies:
+			if !ok {
+				// the request has gone out, so this isn't a bad connection for
+				// the bus to try again on
+				return driver.Delivery{}, fmt.Errorf("rabbit channel closed waiting for reply")
+			}
+			// replies to earlier requests that gave up waiting can still turn up
+			if id, _ := msg.Headers[headerCausationID].(string); id != env.ID {
+				continue
+			}
+			return driver.Delivery{
+				Envelope:    envelope(msg, topic, originalRoutingKey(msg)),
+				ContentType: msg.ContentType,
+				Body:        msg.Body,
+			}, nil
+		}
+	}
+}
+
+// Reply implements driver.ConnRequest, replyTo is the requester's direct reply-to
+// address, published to through the default exchange. If the requester has gone
+// the broker just drops it.
+func (r *rabbit) Reply(ctx context.Context, replyTo string, reply driver.Delivery) error {
+	if r.ch.IsClosed() {
+		return driver.ErrBadConn
+	}
+
+	err := r.ch.PublishWithContext(
+		ctx,
+		"",      // default exchange
+		replyTo, // routing key
+		false,   // mandatory
+		false,   // immediate
 		amqp.Publishing{
-			Timestamp:    time.Now(),
-			ContentType:  "application/json",
-			Body:         body,
-			DeliveryMode: 2, // persistent
+			Headers:       headers(reply.Envelope),
+			MessageId:     reply.Envelope.ID,
+			CorrelationId: reply.Envelope.CorrelationID,
+			Timestamp:     reply.Envelope.Timestamp,
+			ContentType:   reply.ContentType,
+			Body:          reply.Body,
 		})
+	if errors.Is(err, amqp.ErrClosed) {
+		return driver.ErrBadConn
+	}
+	return err
+}
+
+func (r *rabbit) Subscribe(ctx context.Context, topics []driver.Topic) error {
+	return r.SubscribeWithOptions(ctx, topics, driver.SubscribeOptions{})
+}
+
+func (r *rabbit) SubscribeWithOptions(ctx context.Context, topics []driver.Topic, opts driver.SubscribeOptions) error {
+	if opts.Workers <= 0 {
+		opts.Workers = r.cfg.Workers
+	}
+	workers := opts.Workers
+
+	// topics with a concurrency of their own are consumed in lanes, so they don't
+	// hold up the workers
+	lanes := driver.NewLanes(topics, workers)
+	defer lanes.Close()
+
+	// a fixed pool of workers handles the deliveries. The prefetch count matches,
+	// along with what the lanes can hold, so the broker never sends more than can
+	// be busy at once.
+	prefetch := workers + lanes.Held()
+
+	tag := consumerTag(r.cfg.Name)
+	msgs, err := r.consume(topics, tag, opts, prefetch)
 	if err != nil {
 		return err
 	}
 
-	if err := <-errs; err != nil {
-		return fmt.Errorf("confirmation failed: %w", err)
+	jobs := make(chan amqp.Delivery)
+	var inflight sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			for msg := range jobs {
+				r.handle(msg, topics, lanes)
+			}
+		}()
 	}
 
-	return nil
+	// drain the workers before returning
+	defer inflight.Wait()
+	defer close(jobs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// stop the broker sending us anything else, anything it already sent
+			// that we have not started on stays unacknowledged and is requeued
+			// once the channel closes
+			r.cancel(tag)
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				// the channel, or the whole connection, has gone away underneath
+				// us. Anything in flight can no longer be acknowledged and will be
+				// redelivered, so just get back to consuming.
+				msgs, err = r.resubscribe(ctx, topics, tag, opts, prefetch)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return err
+				}
+				continue
+			}
+
+			select {
+			case jobs <- msg:
+			case <-ctx.Done():
+				r.cancel(tag)
+				return nil
+			}
+		}
+	}
 }
 
-func (r *rabbit) Subscribe(ctx context.Context, topics []driver.Topic) error {
-	defer r.ch.Close()
-	defer r.conn.Close()
+func (r *rabbit) cancel(tag string) {
+	if err := r.ch.Cancel(tag, false); err != nil {
+		r.connector.log().Warn("rabbit unable to cancel consumer", "consumer_tag", tag, "error", err)
+	}
+}
+
+// consume declares everything the subscription needs on the current channel
+// and starts consuming from our queue. It is safe to call again on a new
+// channel, as all the declarations are idempotent.
+func (r *rabbit) consume(topics []driver.Topic, tag string, opts driver.SubscribeOptions, prefetch int) (<-chan amqp.Delivery, error) {
+	// only have as many unacknowledged messages sent to us as we can be busy with
+	err := r.ch.Qos(prefetch, 0, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set prefetch count: %w", err)
+	}
+
 	// create the exchanges
-	err := r.declareExchange(topics)
+	err = r.declareExchange(topics)
 	if err != nil {
-		return fmt.Errorf("unable to create exchanges: %w", err)
+		return nil, fmt.Errorf("unable to create exchanges: %w", err)
 	}
 
 	// ensure our queue exists, using configuration name
-	_, err = r.declareQueue(r.cfg.Name)
+	_, err = r.declareQueue(r.cfg.Name, topics)
 	if err != nil {
-		return fmt.Errorf("declare queue: %w", err)
+		return nil, fmt.Errorf("declare queue: %w", err)
 	}
 
 	// bind topics to our queue
 	for _, topic := range topics {
 		innerErr := r.ch.QueueBind(
-			fmt.Sprintf("%s%s", os.Getenv("BUS_PREFIX"), r.cfg.Name),
-			topic.Name,
-			fmt.Sprintf("%s%s", os.Getenv("BUS_PREFIX"), topic.Exchange),
+			r.cfg.queueName(),
+			r.bindingKey(topic, opts.Tenant),
+			fmt.Sprintf("%s%s", r.cfg.Prefix, topic.Exchange),
 			false, // no wait
 			nil,   // args
 		)
 		if innerErr != nil {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"unable to bind queue %q with exchange %q for topic %q: err: %w",
-				fmt.Sprintf("%s%s", os.Getenv("BUS_PREFIX"), r.cfg.Name),
-				fmt.Sprintf("%s%s", os.Getenv("BUS_PREFIX"), topic.Exchange),
+				r.cfg.queueName(),
+				fmt.Sprintf("%s%s", r.cfg.Prefix, topic.Exchange),
 				topic.Name,
 				innerErr,
 			)
@@ -124,61 +298,133 @@ func (r *rabbit) Subscribe(ctx context.Context, topics []driver.Topic) error {
 	}
 
 	msgs, err := r.ch.Consume(
-		fmt.Sprintf("%s%s", os.Getenv("BUS_PREFIX"), r.cfg.Name), // queue
-		"",    // consumer
-		false, // auto awk
-		false, // exclusive
-		false, // noLocal
-		false, // noWait
-		nil,   // args
+		r.cfg.queueName(), // queue
+		tag,               // consumer
+		false,             // auto awk
+		false,             // exclusive
+		false,             // noLocal
+		false,             // noWait
+		nil,               // args
 	)
 	if err != nil {
-		return fmt.Errorf("unable to consume message from queue %s: %w", r.cfg.Name, err)
+		return nil, fmt.Errorf("unable to consume message from queue %s: %w", r.cfg.Name, err)
 	}
 
-	for msg := range msgs {
-		go func(msg amqp.Delivery) {
-			// split the routing key, should be 3 parts, into a standard struct.
-			// log an error if it fails.
-			key, err := routingKeySplit(msg.RoutingKey)
-			if err != nil {
-				// log our error
-				log.Print(err)
-
-				// sent no acknowledgement back, and requeue the message (this will blow up data dog intentionally!)
-				err = msg.Nack(false, true)
-				if err != nil {
-					log.Printf("rabbit acknowledgement unsuccessful: %s", err)
-				}
+	return msgs, nil
+}
 
-				return
-			}
+// resubscribe opens a new channel, waiting for the connector to reconnect if
+// needed, and starts consuming again. It retries with backoff until it succeeds,
+// ctx is done, or the connection is closed.
+func (r *rabbit) resubscribe(ctx context.Context, topics []driver.Topic, tag string, opts driver.SubscribeOptions, prefetch int) (<-chan amqp.Delivery, error) {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-			t := key.match(topics)
-			// there are some arguments that we should always pass the delivery and not just the body
-			// so we can act on other things too... hypotheticals though so I'm not adding it
-			err = t.Consumer(msg.Body)
-			if err != nil {
-				log.Printf(
-					"consumer had an issue processing an event message: %s, err: %s",
-					msg.Body,
-					err,
-				)
-
-				err = msg.Nack(false, true)
-				if err != nil {
-					log.Printf("rabbit acknowledgement unsuccessful: %s", err)
-				}
+		r.mu.Lock()
+		closed := r.closed
+		r.mu.Unlock()
+		if closed {
+			return nil, fmt.Errorf("rabbit connection closed while resubscribing")
+		}
 
-				return
-			}
-			err = msg.Ack(false)
-			if err != nil {
-				log.Printf("rabbit acknowledgement unsuccessful: %s", err)
+		con, ch, err := r.connector.channel(ctx)
+		if errors.Is(err, errConnectorClosed) {
+			return nil, err
+		}
+		if err == nil {
+			r.mu.Lock()
+			old := r.ch
+			r.conn, r.ch = con, ch
+			r.mu.Unlock()
+			old.Close()
+
+			var msgs <-chan amqp.Delivery
+			msgs, err = r.consume(topics, tag, opts, prefetch)
+			if err == nil {
+				r.connector.log().Info("rabbit resumed consuming", "queue", r.cfg.queueName())
+				return msgs, nil
 			}
-		}(msg)
+		}
+
+		r.connector.log().Warn("rabbit unable to resume consuming", "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(driver.Jitter(driver.Backoff(attempt, r.cfg.ReconnectDelay, r.cfg.ReconnectMaxDelay))):
+		}
 	}
-	return nil
+}
+
+// handle passes a single delivery to the matching topic consumer, in the topic's
+// lane if it has one.
+func (r *rabbit) handle(msg amqp.Delivery, topics []driver.Topic, lanes *driver.Lanes) {
+	// messages coming back from a retry queue have the original routing key in a header
+	routingKey := originalRoutingKey(msg)
+
+	t, ok := driver.MatchTopic(topics, routingKey)
+	if !ok {
+		err := fmt.Errorf("routing key %q matches none of our topics, cannot process message", routingKey)
+		r.connector.log().Error("rabbit cannot route message",
+			"routing_key", routingKey,
+			"message_id", msg.MessageId,
+			"error", err,
+		)
+
+		// no amount of retrying will make this routable, straight to the dead letter queue
+		r.connector.metrics.Add(driver.MetricDeadLettered, "")
+		r.deadLetter(msg, routingKey, err)
+		return
+	}
+
+	lanes.Do(t, func() {
+		r.consumeMessage(msg, t, routingKey)
+	})
+}
+
+// consumeMessage passes a delivery to the topic's consumer, acknowledging it on
+// success.
+func (r *rabbit) consumeMessage(msg amqp.Delivery, t driver.Topic, routingKey string) {
+	env := envelope(msg, t, routingKey)
+	err := t.Consumer(r.consumeCtx, driver.Delivery{
+		Envelope:    env,
+		ContentType: msg.ContentType,
+		Body:        msg.Body,
+	})
+	if err != nil {
+		r.connector.log().Warn("consumer had an issue processing an event message",
+			"topic", t.Name,
+			"routing_key", routingKey,
+			"message_id", env.ID,
+			"attempt", env.Attempt,
+			"payload", msg.Body,
+			"error", err,
+		)
+
+		r.retry(msg, t, routingKey, err)
+		return
+	}
+	err = msg.Ack(false)
+	if err != nil {
+		r.connector.log().Warn("rabbit acknowledgement unsuccessful", "message_id", env.ID, "error", err)
+	}
+}
+
+// Close closes the channel, and cancels the context of any consumers still
+// running. The connection is shared and owned by the connector.
+func (r *rabbit) Close() error {
+	r.stopConsume()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	if r.ch.IsClosed() {
+		return nil
+	}
+	return r.ch.Close()
 }
 
 const (
@@ -187,25 +433,26 @@ const (
 	ExpiresTime = 259200000
 )
 
-// QueueType defines the queue type
+// QueueType defines the default queue type, overridden by queue_type in the DSN.
 // each queue is in a quorum to add resiliency and speed of recovery this
 // must be set by client (and cannot be set by a policy) see:
 // https://www.rabbitmq.com/quorum-queues.html#declaring
 var QueueType = "quorum"
 
-func (r *rabbit) declareQueue(name string) (amqp.Queue, error) {
+func (r *rabbit) declareQueue(name string, topics []driver.Topic) (amqp.Queue, error) {
 	// CHANGING ANY OF THE BELOW WILL CAUSE YOUR SERVICE TO NOT START IF AN EXISTING QUEUE IS DECLARED WITH DIFFERENT VALUES
 	args := make(amqp.Table)
 	args["x-expires"] = ExpiresTime
-	args["x-queue-type"] = QueueType
+	args["x-queue-type"] = r.cfg.QueueType
 
 	// QueueDeclarePassive can also be used to check for the existence of a queue
 	// if one is found we could just connect to it and use whatever params are currently existing.
 	// this may be an appealing option for the operations team, as we can change params live without causing breaks
 	// TODO: make a pro con list lawls
+	name = fmt.Sprintf("%s%s", r.cfg.Prefix, name)
 	queue, err := r.ch.QueueDeclare(
 		// if name is left empty, rabbit will decide one randomly, it's important we always define one
-		fmt.Sprintf("%s%s", os.Getenv("BUS_PREFIX"), name), // name
+		name,  // name
 		true,  // durable
 		false, // delete when unused
 		false, // exclusive
@@ -216,13 +463,19 @@ func (r *rabbit) declareQueue(name string) (amqp.Queue, error) {
 		return amqp.Queue{}, fmt.Errorf("unable to create queue: %w", err)
 	}
 
+	// the retry and dead letter queues are declared separately, rather than as
+	// arguments on the queue above, so existing queues don't need to be recreated
+	if err := r.declareRetry(topics); err != nil {
+		return amqp.Queue{}, err
+	}
+
 	return queue, nil
 }
 
 func (r *rabbit) declareExchange(topics []driver.Topic) error {
 	for _, t := range topics {
 		err := r.ch.ExchangeDeclare(
-			fmt.Sprintf("%s%s", os.Getenv("BUS_PREFIX"), t.Exchange), // exchange name
+			fmt.Sprintf("%s%s", r.cfg.Prefix, t.Exchange), // exchange name
 			"topic", // type (always topic)
 			true,    // durable
 			false,   // auto-deleted
@@ -237,29 +490,11 @@ func (r *rabbit) declareExchange(topics []driver.Topic) error {
 	return nil
 }
 
-func routingKeySplit(key string) (route, error) {
-	r := route{}
-
-	s := strings.Split(key, ".")
-	if len(s) < 3 {
-		return r, fmt.Errorf("routing key improperly formatted: %s cannot process message", key)
-	}
-
-	r.resource = s[0]
-	r.action = s[1]
+var consumerSeq uint64
 
-	return r, nil
-}
-
-func (r route) match(topics []driver.Topic) driver.Topic {
-	for _, t := range topics {
-		// do the resources match, or does our topic want all
-		if t.Resource() == r.resource || t.Resource() == "*" {
-			// do the verbs match, or does our topic want all
-			if t.Action() == r.action || t.Action() == "*" {
-				return t
-			}
-		}
-	}
-	return driver.Topic{}
+// consumerTag returns a tag unique to this process, so the consumer can be
+// cancelled by name.
+func consumerTag(name string) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%s-%d-%d", name, host, os.Getpid(), atomic.AddUint64(&consumerSeq, 1))
 }
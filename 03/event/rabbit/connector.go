@@ -1,46 +1,256 @@
 package rabbit
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// errConnectorClosed is returned when connecting through a closed connector.
+var errConnectorClosed = fmt.Errorf("rabbit connector is closed")
+
+// connector holds a single long lived AMQP connection, each driver.Conn handed
+// out is a channel on top of it. If the broker closes the connection it is dialed
+// again in the background, with backoff, until it succeeds or the connector is closed.
 type connector struct {
 	cfg config
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	ready   chan struct{} // closed while conn is usable
+	closed  bool
+	done    chan struct{}
+	onState func(driver.ConnEvent)
+	metrics driver.Metrics
+	logger  driver.Logger
+
+	// delays are the delay queues declared already, by name
+	delays sync.Map
 }
 
-func (c connector) Connect() (driver.Conn, error) {
-	str := fmt.Sprintf(
-		"%s://%s:%s@%s:%s",
-		c.cfg.Scheme,
-		c.cfg.Username,
-		c.cfg.Password,
-		c.cfg.Host,
-		c.cfg.Port,
-	)
-	con, err := amqp.DialConfig(
-		str,
-		amqp.Config{Properties: amqp.Table{"connection_name": c.cfg.Name}},
-	)
-	if err != nil {
-		return nil, fmt.Errorf("unable to connect to rabbitmq: %w", err)
+func newConnector(cfg config) *connector {
+	return &connector{
+		cfg:     cfg,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+		metrics: driver.NopMetrics{},
+		logger:  driver.StdLogger{},
 	}
+}
 
-	ch, err := con.Channel()
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	con, ch, err := c.channel(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open unique channel: %w", err)
+		return nil, err
 	}
 
+	consumeCtx, stop := driver.ConsumeContext(ctx)
 	ret := &rabbit{
-		cfg:  c.cfg,
-		conn: con,
-		ch:   ch,
+		cfg:         c.cfg,
+		connector:   c,
+		conn:        con,
+		ch:          ch,
+		consumeCtx:  consumeCtx,
+		stopConsume: stop,
 	}
 	return ret, nil
 }
 
-func (c connector) Driver() driver.Driver {
+// channel opens a new channel on the shared connection, waiting for the
+// connection to come back if it is being re-established.
+func (c *connector) channel(ctx context.Context) (*amqp.Connection, *amqp.Channel, error) {
+	con, err := c.connection(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, err := con.Channel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open unique channel: %w", err)
+	}
+
+	// every channel is put in confirm mode up front, so pushes can wait for the
+	// broker to take responsibility for the message
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, nil, fmt.Errorf("channel could not be put into confirm mode: %w", err)
+	}
+
+	return con, ch, nil
+}
+
+// connection returns the shared connection, waiting until ctx is done for it to
+// be re-established if it has been lost.
+func (c *connector) connection(ctx context.Context) (*amqp.Connection, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, errConnectorClosed
+		}
+		if c.conn != nil && !c.conn.IsClosed() {
+			con := c.conn
+			c.mu.Unlock()
+			return con, nil
+		}
+		ready := c.ready
+		c.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// open dials the broker for the first time, so a bad configuration is reported
+// straight away rather than retried.
+func (c *connector) open() error {
+	con, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	c.setConnection(con)
+	return nil
+}
+
+func (c *connector) dial() (*amqp.Connection, error) {
+	cfg, err := c.cfg.amqpConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure rabbitmq connection: %w", err)
+	}
+
+	con, err := amqp.DialConfig(c.cfg.url(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to rabbitmq: %w", err)
+	}
+
+	return con, nil
+}
+
+func (c *connector) setConnection(con *amqp.Connection) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		con.Close()
+		return
+	}
+	c.conn = con
+	close(c.ready)
+	c.mu.Unlock()
+
+	go c.watch(con)
+}
+
+// watch waits for the connection to close, and starts reconnecting unless it was
+// closed by us.
+func (c *connector) watch(con *amqp.Connection) {
+	amqpErr, ok := <-con.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok || amqpErr == nil {
+		// graceful close, nothing to do
+		return
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.ready = make(chan struct{})
+	c.mu.Unlock()
+
+	c.log().Warn("rabbit connection lost", "error", amqpErr)
+	c.notify(driver.ConnEvent{State: driver.StateDisconnected, Err: amqpErr})
+
+	c.reconnect(amqpErr)
+}
+
+// reconnect dials the broker with backoff until it succeeds or the connector is closed.
+func (c *connector) reconnect(cause error) {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(driver.Jitter(driver.Backoff(attempt, c.cfg.ReconnectDelay, c.cfg.ReconnectMaxDelay))):
+		}
+
+		c.notify(driver.ConnEvent{State: driver.StateReconnecting, Attempt: attempt, Err: cause})
+
+		con, err := c.dial()
+		if err != nil {
+			c.log().Warn("rabbit reconnect failed", "attempt", attempt, "error", err)
+			cause = err
+			continue
+		}
+
+		c.setConnection(con)
+		c.notify(driver.ConnEvent{State: driver.StateConnected})
+		return
+	}
+}
+
+// SetMetrics implements driver.ConnectorMetrics.
+func (c *connector) SetMetrics(m driver.Metrics) {
+	c.metrics = m
+}
+
+// SetLogger implements driver.ConnectorLogger.
+func (c *connector) SetLogger(l driver.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logger = l
+}
+
+// log returns the logger, which may be set while the connection is being watched.
+func (c *connector) log() driver.Logger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logger
+}
+
+// NotifyState implements driver.ConnStateNotifier.
+func (c *connector) NotifyState(f func(driver.ConnEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onState = f
+}
+
+func (c *connector) notify(e driver.ConnEvent) {
+	c.mu.Lock()
+	f := c.onState
+	c.mu.Unlock()
+
+	if f != nil {
+		f(e)
+	}
+}
+
+// Close closes the shared connection, and with it every channel handed out, and
+// stops any reconnecting.
+func (c *connector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+func (c *connector) Driver() driver.Driver {
 	return BusDriver{}
 }
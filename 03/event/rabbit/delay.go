@@ -0,0 +1,110 @@
+package rabbit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Delayed messages work the same way as retries. The message is published to a
+// delay exchange, routed to a delay queue with no consumers and a message TTL,
+// and once the TTL is up the broker dead letters it onto the topic's exchange
+// with the routing key it was published with.
+//
+// A queue only expires the message at its head, so every delay gets a queue of
+// its own. To keep the number of queues down, delays are rounded up into buckets,
+// which is how late a message can be: up to a second for delays under a minute,
+// a minute for delays under an hour, and an hour beyond that. Each bucket has an
+// exchange too, as publishing straight to the queue would swap the routing key
+// for the queue's name.
+
+// delayBucket rounds the delay up to its bucket.
+func delayBucket(delay time.Duration) time.Duration {
+	step := time.Hour
+	switch {
+	case delay <= time.Minute:
+		step = time.Second
+	case delay <= time.Hour:
+		step = time.Minute
+	}
+
+	bucket := delay.Truncate(step)
+	if bucket < delay {
+		bucket += step
+	}
+	return bucket
+}
+
+func (c config) delayName(exchange string, delay time.Duration) string {
+	return fmt.Sprintf("%s%s.delay.%d", c.Prefix, exchange, delay.Milliseconds())
+}
+
+// PushAt implements driver.ConnPushAt.
+func (r *rabbit) PushAt(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message, at time.Time) error {
+	if env.RoutingKey == "" {
+		env.RoutingKey = topic.Name
+	}
+
+	if r.ch.IsClosed() {
+		return driver.ErrBadConn
+	}
+
+	delay := delayBucket(time.Until(at))
+	if err := r.declareDelay(topic, delay); err != nil {
+		return err
+	}
+	return r.publish(ctx, r.cfg.delayName(topic.Exchange, delay), topic, env, m)
+}
+
+// declareDelay declares the delay exchange and queue for the topic's exchange
+// and the delay, if they haven't been already.
+func (r *rabbit) declareDelay(topic driver.Topic, delay time.Duration) error {
+	name := r.cfg.delayName(topic.Exchange, delay)
+	if _, ok := r.connector.delays.Load(name); ok {
+		return nil
+	}
+
+	// it is dead lettered onto the exchange, so that needs to exist as well
+	if err := r.declareExchange([]driver.Topic{topic}); err != nil {
+		return fmt.Errorf("unable to create exchange: %w", err)
+	}
+
+	err := r.ch.ExchangeDeclare(
+		name,     // exchange name
+		"fanout", // type, everything goes to the one queue
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create delay exchange for %s: %w", delay, err)
+	}
+
+	// no x-expires, the same as the retry queues
+	_, err = r.ch.QueueDeclare(
+		name,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-message-ttl":          delay.Milliseconds(),
+			"x-dead-letter-exchange": fmt.Sprintf("%s%s", r.cfg.Prefix, topic.Exchange),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create delay queue for %s: %w", delay, err)
+	}
+
+	if err := r.ch.QueueBind(name, "", name, false, nil); err != nil {
+		return fmt.Errorf("unable to bind delay queue for %s: %w", delay, err)
+	}
+
+	r.connector.delays.Store(name, true)
+	return nil
+}
@@ -11,17 +11,26 @@ import (
 
 type BusDriver struct{}
 
-// OpenConnector opens a connection to the event bus
+// OpenConnector always fails, there is no default service name, see
+// OpenConnectorDSN.
 func (r BusDriver) OpenConnector() (driver.Connector, error) {
-	cfg := NewConfig()
+	return r.OpenConnectorDSN("")
+}
+
+// OpenConnectorDSN opens a connection to the event bus configured by dsn, see
+// ParseDSN for its format.
+func (r BusDriver) OpenConnectorDSN(dsn string) (driver.Connector, error) {
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
 	if cfg.Name == "" {
 		return nil, fmt.Errorf("bus name variable is not set, each service needs this set in order to declare a queue")
 	}
-	conn := connector{cfg: cfg}
+	conn := newConnector(cfg)
 
 	// create a connection to ensure it works
-	_, err := conn.Connect()
-	if err != nil {
+	if err := conn.open(); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,103 @@
+package rabbit
+
+import (
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// headerCausationID holds the envelope's causation ID, AMQP has properties
+	// for the message and correlation IDs but nothing for this one.
+	headerCausationID = "x-causation-id"
+	// headerTenant holds the tenant the message belongs to.
+	headerTenant = "x-tenant"
+
+	// directReplyTo is rabbit's pseudo-queue for replies, see
+	// https://www.rabbitmq.com/direct-reply-to.html
+	directReplyTo = "amq.rabbitmq.reply-to"
+)
+
+// internalHeaders are used by the driver itself and not passed on to consumers.
+var internalHeaders = map[string]bool{
+	headerCausationID:   true,
+	headerTenant:        true,
+	headerRoutingKey:    true,
+	headerRetryCount:    true,
+	headerDeliveryCount: true,
+	headerError:         true,
+	"x-death":           true,
+}
+
+// headers builds the AMQP headers for the envelope. The routing key is always
+// carried in a header too, as the key the broker sees can have the tenant added
+// or be swapped for a queue name on its way through a retry queue.
+func headers(env driver.Envelope) amqp.Table {
+	h := make(amqp.Table, len(env.Headers)+3)
+	for k, v := range env.Headers {
+		h[k] = v
+	}
+	h[headerRoutingKey] = env.RoutingKey
+	if env.CausationID != "" {
+		h[headerCausationID] = env.CausationID
+	}
+	if env.Tenant != "" {
+		h[headerTenant] = env.Tenant
+	}
+	return h
+}
+
+// routingKey is the key the message is published with. With tenant routing on,
+// the tenant is added as the last word so the broker can route on it.
+func (r *rabbit) routingKey(env driver.Envelope) string {
+	if r.cfg.TenantRoutingKey && env.Tenant != "" {
+		return env.RoutingKey + "." + env.Tenant
+	}
+	return env.RoutingKey
+}
+
+// bindingKey is the key our queue is bound to the topic's exchange with. With
+// tenant routing on, only the tenant's messages are bound, or every tenant's
+// (and untenanted) messages if there is no tenant.
+func (r *rabbit) bindingKey(topic driver.Topic, tenant string) string {
+	if !r.cfg.TenantRoutingKey {
+		return topic.Name
+	}
+	if tenant == "" {
+		return topic.Name + ".#"
+	}
+	return topic.Name + "." + tenant
+}
+
+// envelope builds the envelope for a delivery consumed on the topic.
+func envelope(msg amqp.Delivery, t driver.Topic, routingKey string) driver.Envelope {
+	env := driver.Envelope{
+		ID:            msg.MessageId,
+		CorrelationID: msg.CorrelationId,
+		Timestamp:     msg.Timestamp,
+		Redelivered:   msg.Redelivered || attempt(msg) > 1,
+		Attempt:       attempt(msg),
+		Topic:         t.Name,
+		RoutingKey:    routingKey,
+		ReplyTo:       msg.ReplyTo,
+	}
+
+	if id, ok := msg.Headers[headerCausationID].(string); ok {
+		env.CausationID = id
+	}
+	if tenant, ok := msg.Headers[headerTenant].(string); ok {
+		env.Tenant = tenant
+	}
+
+	for k, v := range msg.Headers {
+		s, ok := v.(string)
+		if !ok || internalHeaders[k] {
+			continue
+		}
+		if env.Headers == nil {
+			env.Headers = make(map[string]string)
+		}
+		env.Headers[k] = s
+	}
+
+	return env
+}
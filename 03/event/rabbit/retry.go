@@ -0,0 +1,250 @@
+package rabbit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Retries don't requeue the failed message, which would send it straight back to
+// us. Instead it is acknowledged and a copy is published to a retry queue for the
+// delay we want. The retry queue has no consumers and a message TTL, so once the
+// TTL is up the broker dead letters the copy back onto our queue.
+//
+// Once the topic's policy runs out of attempts the message is published to our
+// dead letter exchange instead, and sits in the dead letter queue for someone to
+// look at.
+const (
+	// headerRoutingKey holds the routing key the message was originally published
+	// with, as coming back from a retry queue it has our queue name instead.
+	headerRoutingKey = "x-routing-key"
+	// headerRetryCount is the number of times the message has been retried.
+	headerRetryCount = "x-retry-count"
+	// headerDeliveryCount is set by quorum queues to the number of times the
+	// message was redelivered after a nack or a consumer going away.
+	headerDeliveryCount = "x-delivery-count"
+	// headerError holds why the message was dead lettered.
+	headerError = "x-error"
+
+	// republishTimeout bounds how long we wait for the broker to confirm a retry
+	// or dead letter, before falling back to requeueing.
+	republishTimeout = 30 * time.Second
+)
+
+func (c config) queueName() string {
+	return fmt.Sprintf("%s%s", c.Prefix, c.Name)
+}
+
+func (c config) deadLetterName() string {
+	return c.queueName() + ".dead"
+}
+
+func (c config) retryQueueName(delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", c.queueName(), delay.Milliseconds())
+}
+
+// retryQueue returns the retry queue for the message after its nth attempt
+// failed, or false once the policy has run out of attempts and it is to be dead
+// lettered.
+func (c config) retryQueue(n int, policy driver.RetryPolicy) (string, bool) {
+	if n >= policy.MaxAttempts {
+		return "", false
+	}
+	return c.retryQueueName(policy.Backoff(n)), true
+}
+
+// attempt returns which delivery attempt this is for the message, starting at 1.
+func attempt(msg amqp.Delivery) int {
+	return 1 + headerInt(msg.Headers, headerRetryCount) + headerInt(msg.Headers, headerDeliveryCount)
+}
+
+// originalRoutingKey returns the routing key the message was published with.
+func originalRoutingKey(msg amqp.Delivery) string {
+	if key, ok := msg.Headers[headerRoutingKey].(string); ok && key != "" {
+		return key
+	}
+	return msg.RoutingKey
+}
+
+func headerInt(h amqp.Table, key string) int {
+	switch v := h[key].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
+
+// retry sends the message to the retry queue for the topic's next backoff, or
+// dead letters it if it has run out of attempts.
+func (r *rabbit) retry(msg amqp.Delivery, t driver.Topic, routingKey string, cause error) {
+	policy := t.RetryPolicy()
+	n := attempt(msg)
+	queue, ok := r.cfg.retryQueue(n, policy)
+	if !ok {
+		r.connector.log().Error("message failed too many times, dead lettering",
+			"topic", t.Name,
+			"routing_key", routingKey,
+			"message_id", msg.MessageId,
+			"attempt", n,
+		)
+		r.connector.metrics.Add(driver.MetricDeadLettered, t.Name)
+		r.deadLetter(msg, routingKey, cause)
+		return
+	}
+	r.connector.metrics.Add(driver.MetricRequeued, t.Name)
+
+	headers := copyHeaders(msg.Headers)
+	headers[headerRoutingKey] = routingKey
+	headers[headerRetryCount] = int32(n)
+	delete(headers, headerDeliveryCount)
+
+	err := r.republish("", queue, msg, headers)
+	r.settle(msg, err)
+}
+
+// deadLetter sends the message to our dead letter queue.
+func (r *rabbit) deadLetter(msg amqp.Delivery, routingKey string, cause error) {
+	headers := copyHeaders(msg.Headers)
+	headers[headerRoutingKey] = routingKey
+	headers[headerError] = cause.Error()
+
+	err := r.republish(r.cfg.deadLetterName(), routingKey, msg, headers)
+	r.settle(msg, err)
+}
+
+// settle acknowledges the original message once its copy has been confirmed by the
+// broker. If the copy could not be published the original is requeued instead, so
+// it is never lost, and quorum queues will count it as another attempt.
+func (r *rabbit) settle(msg amqp.Delivery, republishErr error) {
+	if republishErr != nil {
+		r.connector.log().Warn("rabbit unable to republish message, requeueing", "message_id", msg.MessageId, "error", republishErr)
+		if err := msg.Nack(false, true); err != nil {
+			r.connector.log().Warn("rabbit acknowledgement unsuccessful", "message_id", msg.MessageId, "error", err)
+		}
+		return
+	}
+
+	if err := msg.Ack(false); err != nil {
+		r.connector.log().Warn("rabbit acknowledgement unsuccessful", "message_id", msg.MessageId, "error", err)
+	}
+}
+
+// republish publishes a copy of msg and waits for the broker to confirm it.
+func (r *rabbit) republish(exchange, key string, msg amqp.Delivery, headers amqp.Table) error {
+	r.mu.Lock()
+	ch := r.ch
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), republishTimeout)
+	defer cancel()
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,
+		key,
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			Headers:       headers,
+			ContentType:   msg.ContentType,
+			MessageId:     msg.MessageId,
+			CorrelationId: msg.CorrelationId,
+			Timestamp:     msg.Timestamp,
+			ReplyTo:       msg.ReplyTo,
+			Body:          msg.Body,
+			DeliveryMode:  amqp.Persistent,
+		})
+	if err != nil {
+		return err
+	}
+
+	if !confirm.Wait() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("broker nacked the message")
+	}
+	return nil
+}
+
+func copyHeaders(h amqp.Table) amqp.Table {
+	c := make(amqp.Table, len(h)+2)
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+// declareRetry declares the dead letter exchange and queue, and a retry queue for
+// every delay the topics' retry policies can produce.
+func (r *rabbit) declareRetry(topics []driver.Topic) error {
+	err := r.ch.ExchangeDeclare(
+		r.cfg.deadLetterName(), // exchange name
+		"fanout",               // type, everything goes to the one queue
+		true,                   // durable
+		false,                  // auto-deleted
+		false,                  // internal
+		false,                  // no-wait
+		nil,                    // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create dead letter exchange: %w", err)
+	}
+
+	// no x-expires on the dead letter queue, the whole point is it sticks around
+	_, err = r.ch.QueueDeclare(
+		r.cfg.deadLetterName(),
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{"x-queue-type": r.cfg.QueueType},
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create dead letter queue: %w", err)
+	}
+
+	err = r.ch.QueueBind(r.cfg.deadLetterName(), "", r.cfg.deadLetterName(), false, nil)
+	if err != nil {
+		return fmt.Errorf("unable to bind dead letter queue: %w", err)
+	}
+
+	declared := make(map[time.Duration]bool)
+	for _, t := range topics {
+		for _, delay := range t.RetryPolicy().Delays() {
+			if declared[delay] {
+				continue
+			}
+			declared[delay] = true
+
+			// no x-expires here either, these queues never have consumers so the
+			// broker would consider them unused and remove them
+			_, err := r.ch.QueueDeclare(
+				r.cfg.retryQueueName(delay),
+				true,  // durable
+				false, // delete when unused
+				false, // exclusive
+				false, // no-wait
+				amqp.Table{
+					"x-message-ttl":             delay.Milliseconds(),
+					"x-dead-letter-exchange":    "",
+					"x-dead-letter-routing-key": r.cfg.queueName(),
+				},
+			)
+			if err != nil {
+				return fmt.Errorf("unable to create retry queue for %s: %w", delay, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package rabbit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueNames(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Prefix = "dev_"
+	cfg.Name = "svc"
+
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{cfg.queueName(), "dev_svc"},
+		{cfg.deadLetterName(), "dev_svc.dead"},
+		{cfg.retryQueueName(1500 * time.Millisecond), "dev_svc.retry.1500"},
+		{cfg.retryQueueName(time.Minute), "dev_svc.retry.60000"},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	tests := []struct {
+		headers amqp.Table
+		want    int
+	}{
+		{nil, 1},
+		{amqp.Table{}, 1},
+		// retried by us, the count coming back as whatever integer the broker
+		// decoded it as
+		{amqp.Table{headerRetryCount: int32(2)}, 3},
+		{amqp.Table{headerRetryCount: int64(2)}, 3},
+		{amqp.Table{headerRetryCount: int16(2)}, 3},
+		{amqp.Table{headerRetryCount: 2}, 3},
+		// redelivered by a quorum queue
+		{amqp.Table{headerDeliveryCount: int64(1)}, 2},
+		{amqp.Table{headerRetryCount: int32(2), headerDeliveryCount: int64(1)}, 4},
+		{amqp.Table{headerRetryCount: "2"}, 1},
+	}
+
+	for _, tt := range tests {
+		if got := attempt(amqp.Delivery{Headers: tt.headers}); got != tt.want {
+			t.Errorf("attempt with headers %v = %d, want %d", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestOriginalRoutingKey(t *testing.T) {
+	tests := []struct {
+		msg  amqp.Delivery
+		want string
+	}{
+		{amqp.Delivery{RoutingKey: "movie.release"}, "movie.release"},
+		// back from a retry queue, routed by our queue name
+		{amqp.Delivery{RoutingKey: "svc", Headers: amqp.Table{headerRoutingKey: "movie.release"}}, "movie.release"},
+		{amqp.Delivery{RoutingKey: "movie.release", Headers: amqp.Table{headerRoutingKey: ""}}, "movie.release"},
+		{amqp.Delivery{RoutingKey: "movie.release", Headers: amqp.Table{headerRoutingKey: 1}}, "movie.release"},
+	}
+
+	for _, tt := range tests {
+		if got := originalRoutingKey(tt.msg); got != tt.want {
+			t.Errorf("originalRoutingKey(%q, %v) = %q, want %q", tt.msg.RoutingKey, tt.msg.Headers, got, tt.want)
+		}
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Name = "svc"
+	policy := driver.RetryPolicy{MaxAttempts: 4, Delay: time.Second, MaxDelay: 2 * time.Second}
+
+	tests := []struct {
+		attempt int
+		// want is the retry queue, empty to be dead lettered
+		want string
+	}{
+		{1, "svc.retry.1000"},
+		{2, "svc.retry.2000"},
+		{3, "svc.retry.2000"},
+		{4, ""},
+		{5, ""},
+	}
+
+	// only the queues for the policy's delays are declared
+	declared := make(map[string]bool)
+	for _, delay := range policy.Delays() {
+		declared[cfg.retryQueueName(delay)] = true
+	}
+
+	for _, tt := range tests {
+		got, ok := cfg.retryQueue(tt.attempt, policy)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("retryQueue(%d) = %q, %v, want %q", tt.attempt, got, ok, tt.want)
+		}
+		if ok && !declared[got] {
+			t.Errorf("retryQueue(%d) = %q, which isn't declared", tt.attempt, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package rabbit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TLS is the transport security for amqps connections. The files are read every
+// time the broker is dialed, so certificates rotated on disk are picked up when
+// reconnecting.
+type TLS struct {
+	// CACertFile is a PEM bundle of the CAs the broker's certificate is verified
+	// against. Empty uses the system pool.
+	CACertFile string
+	// CertFile and KeyFile are the PEM client certificate and key presented to
+	// the broker, for mutual TLS. Both or neither must be set.
+	CertFile string
+	KeyFile  string
+	// ServerName is the name the broker's certificate is verified against, and
+	// sent for SNI. Empty uses the host.
+	ServerName string
+	// InsecureSkipVerify turns off verifying the broker's certificate. Only for
+	// development brokers with self signed certificates.
+	InsecureSkipVerify bool
+}
+
+// enabled reports whether any TLS option has been set.
+func (t TLS) enabled() bool {
+	return t != TLS{}
+}
+
+// authExternal is the auth_mechanism for authenticating with the client
+// certificate, rather than a username and password.
+const authExternal = "external"
+
+// parseTLS reads the TLS options of a DSN, using the same query parameters as the
+// RabbitMQ URI spec: https://www.rabbitmq.com/uri-query-parameters.html
+func parseTLS(cfg *config, q url.Values) error {
+	get := q.Get
+
+	cfg.TLS.CACertFile = get("cacertfile")
+	cfg.TLS.CertFile = get("certfile")
+	cfg.TLS.KeyFile = get("keyfile")
+	cfg.TLS.ServerName = get("server_name_indication")
+
+	switch v := get("verify"); v {
+	case "", "verify_peer":
+	case "verify_none":
+		cfg.TLS.InsecureSkipVerify = true
+	default:
+		return fmt.Errorf("rabbit: invalid verify %q, must be verify_peer or verify_none", v)
+	}
+
+	switch v := strings.ToLower(get("auth_mechanism")); v {
+	case "", "plain":
+	case authExternal:
+		cfg.AuthMechanism = authExternal
+	default:
+		return fmt.Errorf("rabbit: invalid auth_mechanism %q, must be plain or external", v)
+	}
+
+	return cfg.validateTLS()
+}
+
+func (c config) validateTLS() error {
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("rabbit: certfile and keyfile must be set together")
+	}
+	if c.Scheme != "amqps" && c.TLS.enabled() {
+		return fmt.Errorf("rabbit: TLS options need the amqps scheme")
+	}
+	if c.AuthMechanism == authExternal && c.TLS.CertFile == "" {
+		return fmt.Errorf("rabbit: auth_mechanism external needs a client certificate")
+	}
+	return nil
+}
+
+// amqpConfig is the configuration the broker is dialed with.
+func (c config) amqpConfig() (amqp.Config, error) {
+	cfg := amqp.Config{
+		Vhost:      c.Vhost,
+		Properties: amqp.Table{"connection_name": c.Name},
+	}
+
+	if c.AuthMechanism == authExternal {
+		cfg.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	}
+
+	if c.Scheme != "amqps" {
+		return cfg, nil
+	}
+
+	tlsCfg, err := c.tlsConfig()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.TLSClientConfig = tlsCfg
+	return cfg, nil
+}
+
+func (c config) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+
+	if c.TLS.CACertFile != "" {
+		pem, err := os.ReadFile(c.TLS.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificates: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates found in %s", c.TLS.CACertFile)
+		}
+	}
+
+	if c.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,194 @@
+package rabbit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self signed certificate and its key as PEM files in a
+// directory of the test's own, returning their paths.
+func writeCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "svc"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestValidateTLS(t *testing.T) {
+	tests := []struct {
+		scheme string
+		tls    TLS
+		auth   string
+		// want is part of the error expected, empty for none
+		want string
+	}{
+		{"amqp", TLS{}, "", ""},
+		{"amqps", TLS{}, "", ""},
+		{"amqps", TLS{CACertFile: "ca.pem", ServerName: "rabbit", InsecureSkipVerify: true}, "", ""},
+		{"amqps", TLS{CertFile: "cert.pem", KeyFile: "key.pem"}, authExternal, ""},
+		{"amqps", TLS{CertFile: "cert.pem"}, "", "certfile and keyfile"},
+		{"amqps", TLS{KeyFile: "key.pem"}, "", "certfile and keyfile"},
+		{"amqp", TLS{CACertFile: "ca.pem"}, "", "amqps"},
+		{"amqp", TLS{InsecureSkipVerify: true}, "", "amqps"},
+		{"amqps", TLS{}, authExternal, "client certificate"},
+		{"amqps", TLS{CACertFile: "ca.pem"}, authExternal, "client certificate"},
+	}
+
+	for _, tt := range tests {
+		cfg := NewConfig()
+		cfg.Scheme = tt.scheme
+		cfg.TLS = tt.tls
+		cfg.AuthMechanism = tt.auth
+
+		err := cfg.validateTLS()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s %+v auth %q: %v", tt.scheme, tt.tls, tt.auth, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s %+v auth %q = %v, want an error containing %q", tt.scheme, tt.tls, tt.auth, err, tt.want)
+		}
+	}
+}
+
+func TestAMQPConfig(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Name = "svc"
+	cfg.Vhost = "movies"
+
+	got, err := cfg.amqpConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Vhost != "movies" || got.Properties["connection_name"] != "svc" {
+		t.Errorf("got vhost %q and properties %v", got.Vhost, got.Properties)
+	}
+	if got.TLSClientConfig != nil || got.SASL != nil {
+		t.Errorf("amqp got TLS %+v and SASL %v, want neither", got.TLSClientConfig, got.SASL)
+	}
+}
+
+func TestAMQPConfigTLS(t *testing.T) {
+	certFile, keyFile := writeCert(t)
+
+	cfg, err := ParseDSN("amqps://rabbit.internal/?name=svc&cacertfile=" + certFile +
+		"&certfile=" + certFile + "&keyfile=" + keyFile +
+		"&server_name_indication=rabbit&auth_mechanism=external")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cfg.amqpConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.SASL) != 1 || got.SASL[0].Mechanism() != "EXTERNAL" {
+		t.Errorf("got SASL %v, want EXTERNAL", got.SASL)
+	}
+
+	tc := got.TLSClientConfig
+	if tc == nil {
+		t.Fatal("no TLS config for amqps")
+	}
+	if tc.MinVersion != tls.VersionTLS12 || tc.ServerName != "rabbit" || tc.InsecureSkipVerify {
+		t.Errorf("got min version %x, server name %q, skipping verify %v", tc.MinVersion, tc.ServerName, tc.InsecureSkipVerify)
+	}
+	if tc.RootCAs == nil {
+		t.Error("CA file not used to verify the broker")
+	}
+	if len(tc.Certificates) != 1 {
+		t.Errorf("got %d client certificates, want 1", len(tc.Certificates))
+	}
+}
+
+// Without a CA file the system pool is used, and without a certificate none is
+// presented.
+func TestAMQPConfigTLSDefaults(t *testing.T) {
+	cfg, err := ParseDSN("amqps://rabbit.internal/?name=svc&verify=verify_none")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cfg.amqpConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SASL != nil {
+		t.Errorf("got SASL %v, want the default", got.SASL)
+	}
+	tc := got.TLSClientConfig
+	if tc == nil {
+		t.Fatal("no TLS config for amqps")
+	}
+	if tc.RootCAs != nil || tc.Certificates != nil || !tc.InsecureSkipVerify || tc.ServerName != "" {
+		t.Errorf("got %+v", tc)
+	}
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	certFile, keyFile := writeCert(t)
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []struct {
+		tls  TLS
+		want string
+	}{
+		{TLS{CACertFile: missing}, "unable to read CA certificates"},
+		// a key is no CA
+		{TLS{CACertFile: keyFile}, "no CA certificates"},
+		{TLS{CertFile: missing, KeyFile: keyFile}, "unable to load client certificate"},
+		{TLS{CertFile: certFile, KeyFile: missing}, "unable to load client certificate"},
+		// the wrong way round
+		{TLS{CertFile: keyFile, KeyFile: certFile}, "unable to load client certificate"},
+	}
+
+	for _, tt := range tests {
+		cfg := NewConfig()
+		cfg.Scheme = "amqps"
+		cfg.TLS = tt.tls
+
+		_, err := cfg.amqpConfig()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v = %v, want an error containing %q", tt.tls, err, tt.want)
+		}
+	}
+}
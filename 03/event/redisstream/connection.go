@@ -0,0 +1,612 @@
+package redisstream
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	redis "github.com/go-redis/redis/v8"
+)
+
+const (
+	// readErrorDelay is how long to wait before reading again after a failed read.
+	readErrorDelay = time.Second
+
+	// replyTTL is how long a reply stream is kept, for replies to requests that
+	// have stopped waiting.
+	replyTTL = time.Minute
+)
+
+type conn struct {
+	cfg     config
+	client  *redis.Client
+	metrics driver.Metrics
+	logger  driver.Logger
+
+	consumeCtx  context.Context
+	stopConsume context.CancelFunc
+}
+
+// job is a stream entry waiting for a worker.
+type job struct {
+	stream  string
+	msg     redis.XMessage
+	attempt int
+}
+
+func (c *conn) Push(ctx context.Context, topic driver.Topic, m driver.Message) error {
+	return c.PushEnvelope(ctx, topic, driver.Envelope{Timestamp: time.Now()}, m)
+}
+
+func (c *conn) PushEnvelope(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message) error {
+	if env.RoutingKey == "" {
+		env.RoutingKey = topic.Name
+	}
+
+	body, err := topic.Codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	v, err := values(env, topic.Codec.ContentType(), body)
+	if err != nil {
+		return err
+	}
+
+	return c.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: c.stream(topic.Exchange),
+		MaxLen: c.cfg.MaxLen,
+		Approx: true,
+		Values: v,
+	}).Err()
+}
+
+// Request implements driver.ConnRequest, the reply is read from a stream of its
+// own, named after the request, which is deleted once we're done with it.
+func (c *conn) Request(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message) (driver.Delivery, error) {
+	env.ReplyTo = c.replyStream(env.ID)
+	defer func() {
+		if err := c.client.Del(context.Background(), env.ReplyTo).Err(); err != nil {
+			c.logger.Warn("redis unable to delete reply stream", "stream", env.ReplyTo, "error", err)
+		}
+	}()
+
+	if err := c.PushEnvelope(ctx, topic, env, m); err != nil {
+		return driver.Delivery{}, err
+	}
+	driver.RequestSent(ctx)
+
+	last := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return driver.Delivery{}, err
+		}
+
+		// don't block past the deadline, a block of 0 is forever
+		block := c.cfg.Block
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < block {
+			block = time.Until(deadline)
+		}
+		if block < time.Millisecond {
+			block = time.Millisecond
+		}
+
+		res, err := c.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{env.ReplyTo, last},
+			Count:   1,
+			Block:   block,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return driver.Delivery{}, ctx.Err()
+			}
+			return driver.Delivery{}, err
+		}
+
+		for _, stream := range res {
+			for _, msg := range stream.Messages {
+				last = msg.ID
+				if field(msg, fieldCausationID) == env.ID {
+					return delivery(msg, topic, 1), nil
+				}
+			}
+		}
+	}
+}
+
+// Reply implements driver.ConnRequest. The reply stream expires, in case the
+// requester isn't there to delete it.
+func (c *conn) Reply(ctx context.Context, replyTo string, reply driver.Delivery) error {
+	v, err := values(reply.Envelope, reply.ContentType, reply.Body)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.XAdd(ctx, &redis.XAddArgs{Stream: replyTo, Values: v})
+		p.Expire(ctx, replyTo, replyTTL)
+		return nil
+	})
+	return err
+}
+
+func (c *conn) Subscribe(ctx context.Context, topics []driver.Topic) error {
+	return c.SubscribeWithOptions(ctx, topics, driver.SubscribeOptions{})
+}
+
+func (c *conn) SubscribeWithOptions(ctx context.Context, topics []driver.Topic, opts driver.SubscribeOptions) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = c.cfg.Workers
+	}
+
+	s := &subscription{
+		conn:     c,
+		consumer: consumerName(c.cfg.Name),
+		workers:  workers,
+		topics:   make(map[string][]driver.Topic),
+		queue:    make(chan job),
+	}
+	for _, t := range topics {
+		stream := c.stream(t.Exchange)
+		if _, ok := s.topics[stream]; !ok {
+			s.streams = append(s.streams, stream)
+		}
+		s.topics[stream] = append(s.topics[stream], t)
+	}
+
+	if err := s.createGroups(ctx); err != nil {
+		return err
+	}
+
+	// topics with a concurrency of their own are consumed in lanes, so they don't
+	// hold up the workers
+	s.lanes = driver.NewLanes(topics, workers)
+
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		s.read(ctx)
+	}()
+	for _, stream := range s.streams {
+		readers.Add(1)
+		go func(stream string) {
+			defer readers.Done()
+			s.reclaim(ctx, stream)
+		}(stream)
+	}
+
+	var inflight sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-s.queue:
+					s.handle(ctx, j)
+				}
+			}
+		}()
+	}
+
+	// anything read but not handled by the time we stop stays pending, and is
+	// claimed by another consumer once it has been idle long enough
+	<-ctx.Done()
+	readers.Wait()
+	inflight.Wait()
+	s.lanes.Close()
+	s.removeConsumer()
+	return nil
+}
+
+// Close cancels the context of any consumers still running. The client is shared
+// and owned by the connector, so is left open.
+func (c *conn) Close() error {
+	c.stopConsume()
+	return nil
+}
+
+// stream is the name of the stream for an exchange.
+func (c *conn) stream(exchange string) string {
+	return c.cfg.Prefix + exchange
+}
+
+// group is the name of our consumer group, shared by every instance of the
+// service.
+func (c *conn) group() string {
+	return c.cfg.Prefix + c.cfg.Name
+}
+
+// replyStream is the stream the reply to the request with the given ID goes to.
+func (c *conn) replyStream(id string) string {
+	return c.cfg.Prefix + "reply." + id
+}
+
+// deadLetterStream holds the messages we gave up on.
+func (c *conn) deadLetterStream() string {
+	return c.group() + ".dead"
+}
+
+type subscription struct {
+	*conn
+	consumer string
+	workers  int
+	streams  []string
+	topics   map[string][]driver.Topic // by stream
+	queue    chan job
+	lanes    *driver.Lanes
+}
+
+// createGroups creates our consumer group on every stream, and the streams too
+// if nothing has been pushed yet. New groups start with the messages pushed from
+// then on, the same as a newly bound queue.
+func (s *subscription) createGroups(ctx context.Context) error {
+	for _, stream := range s.streams {
+		err := s.client.XGroupCreateMkStream(ctx, stream, s.group(), "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("unable to create consumer group %s on stream %s: %w", s.group(), stream, err)
+		}
+	}
+	return nil
+}
+
+// read reads new messages for the workers until ctx is done.
+func (s *subscription) read(ctx context.Context) {
+	args := &redis.XReadGroupArgs{
+		Group:    s.group(),
+		Consumer: s.consumer,
+		Count:    int64(s.workers),
+		Block:    s.cfg.Block,
+	}
+	for _, stream := range s.streams {
+		args.Streams = append(args.Streams, stream)
+	}
+	for range s.streams {
+		args.Streams = append(args.Streams, ">")
+	}
+
+	for ctx.Err() == nil {
+		res, err := s.client.XReadGroup(ctx, args).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Warn("redis unable to read from streams", "streams", s.streams, "error", err)
+
+			// the stream has been deleted from under us, along with our group
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				if err := s.createGroups(ctx); err != nil {
+					s.logger.Error("redis unable to create consumer groups", "error", err)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(readErrorDelay):
+			}
+			continue
+		}
+
+		for _, stream := range res {
+			for _, msg := range stream.Messages {
+				if !s.dispatch(ctx, job{stream: stream.Stream, msg: msg, attempt: 1}) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// reclaim periodically claims messages left pending by consumers that have gone
+// away, until ctx is done.
+func (s *subscription) reclaim(ctx context.Context, stream string) {
+	interval := s.cfg.ClaimMinIdle / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := "0-0"
+		for {
+			msgs, next, err := s.autoClaim(ctx, stream, start)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.logger.Warn("redis unable to claim pending messages", "stream", stream, "error", err)
+				}
+				break
+			}
+
+			for _, msg := range msgs {
+				s.logger.Info("redis claimed message from a consumer that went away", "stream", stream, "entry_id", msg.ID)
+				if !s.dispatch(ctx, job{stream: stream, msg: msg, attempt: s.deliveries(ctx, stream, msg.ID)}) {
+					return
+				}
+			}
+
+			if next == "0-0" {
+				break
+			}
+			start = next
+		}
+
+		s.removeIdleConsumers(ctx, stream)
+	}
+}
+
+// autoClaim claims a page of messages idle for longer than ClaimMinIdle, starting
+// from start, and returns the ID to start the next page from. It is sent by hand
+// as go-redis v8 can't read the reply Redis 7 sends, which has a third element
+// listing deleted entries.
+func (s *subscription) autoClaim(ctx context.Context, stream, start string) ([]redis.XMessage, string, error) {
+	res, err := s.client.Do(ctx,
+		"xautoclaim", stream, s.group(), s.consumer,
+		s.cfg.ClaimMinIdle.Milliseconds(), start, "count", s.workers,
+	).Slice()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(res) < 2 {
+		return nil, "", fmt.Errorf("unexpected xautoclaim reply %v", res)
+	}
+
+	next, _ := res[0].(string)
+	entries, _ := res[1].([]any)
+
+	msgs := make([]redis.XMessage, 0, len(entries))
+	for _, e := range entries {
+		// entries deleted while pending have no fields, and are acknowledged below
+		// as they match none of our topics
+		entry, ok := e.([]any)
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		id, _ := entry[0].(string)
+		fields, _ := entry[1].([]any)
+
+		msg := redis.XMessage{ID: id, Values: make(map[string]any, len(fields)/2)}
+		for i := 0; i+1 < len(fields); i += 2 {
+			k, _ := fields[i].(string)
+			msg.Values[k] = fields[i+1]
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, next, nil
+}
+
+// removeConsumer deletes our consumer from the group on every stream, so every
+// subscription doesn't leave one behind. Deleting a consumer drops what is pending
+// with it, so if anything is, it is left for another instance to claim and
+// delete, see removeIdleConsumers.
+func (s *subscription) removeConsumer() {
+	ctx := context.Background()
+
+	for _, stream := range s.streams {
+		pending, err := s.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   stream,
+			Group:    s.group(),
+			Start:    "-",
+			End:      "+",
+			Count:    1,
+			Consumer: s.consumer,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			s.logger.Warn("redis unable to check pending messages", "stream", stream, "consumer", s.consumer, "error", err)
+			continue
+		}
+		if len(pending) > 0 {
+			s.logger.Info("redis messages left pending, leaving consumer to be claimed from", "stream", stream, "consumer", s.consumer)
+			continue
+		}
+
+		if err := s.client.XGroupDelConsumer(ctx, stream, s.group(), s.consumer).Err(); err != nil {
+			s.logger.Warn("redis unable to delete consumer", "stream", stream, "consumer", s.consumer, "error", err)
+		}
+	}
+}
+
+// removeIdleConsumers deletes the consumers on the stream with nothing pending
+// that have been idle for longer than ClaimMinIdle, which are those that went
+// away once their messages have been claimed. A consumer that is only quiet is
+// recreated by its next read. It is sent by hand for the same reason as
+// autoClaim, go-redis v8 can't read the reply newer versions of Redis send.
+func (s *subscription) removeIdleConsumers(ctx context.Context, stream string) {
+	res, err := s.client.Do(ctx, "xinfo", "consumers", stream, s.group()).Slice()
+	if err != nil {
+		if ctx.Err() == nil {
+			s.logger.Warn("redis unable to list consumers", "stream", stream, "error", err)
+		}
+		return
+	}
+
+	for _, c := range res {
+		info, _ := c.([]any)
+
+		var (
+			name          string
+			pending, idle int64
+		)
+		for i := 0; i+1 < len(info); i += 2 {
+			k, _ := info[i].(string)
+			switch k {
+			case "name":
+				name, _ = info[i+1].(string)
+			case "pending":
+				pending, _ = info[i+1].(int64)
+			case "idle":
+				idle, _ = info[i+1].(int64)
+			}
+		}
+
+		if name == "" || name == s.consumer || pending > 0 || time.Duration(idle)*time.Millisecond < s.cfg.ClaimMinIdle {
+			continue
+		}
+		if err := s.client.XGroupDelConsumer(ctx, stream, s.group(), name).Err(); err != nil {
+			s.logger.Warn("redis unable to delete consumer", "stream", stream, "consumer", name, "error", err)
+		}
+	}
+}
+
+// deliveries returns how many times a pending message has been delivered.
+func (s *subscription) deliveries(ctx context.Context, stream, id string) int {
+	pending, err := s.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  s.group(),
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 1
+	}
+	return int(pending[0].RetryCount)
+}
+
+// dispatch hands a job to the workers, returning false if ctx is done first.
+func (s *subscription) dispatch(ctx context.Context, j job) bool {
+	select {
+	case s.queue <- j:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// handle passes a message to the matching topic consumer, in the topic's lane if
+// it has one.
+func (s *subscription) handle(ctx context.Context, j job) {
+	routingKey := field(j.msg, fieldRoutingKey)
+
+	t, ok := driver.MatchTopic(s.topics[j.stream], routingKey)
+	if !ok {
+		// the stream has every message pushed to the exchange, this one is for
+		// none of our topics
+		s.ack(j)
+		return
+	}
+
+	s.lanes.Do(t, func() {
+		s.consume(ctx, j, t, routingKey)
+	})
+}
+
+// consume passes a message to the topic's consumer, acknowledging it on success.
+func (s *subscription) consume(ctx context.Context, j job, t driver.Topic, routingKey string) {
+	d := delivery(j.msg, t, j.attempt)
+	err := t.Consumer(s.consumeCtx, d)
+	if err == nil {
+		s.ack(j)
+		return
+	}
+
+	s.logger.Warn("consumer had an issue processing an event message",
+		"topic", t.Name,
+		"routing_key", routingKey,
+		"message_id", d.Envelope.ID,
+		"attempt", j.attempt,
+		"payload", d.Body,
+		"error", err,
+	)
+
+	policy := t.RetryPolicy()
+	if j.attempt >= policy.MaxAttempts {
+		s.logger.Error("message failed too many times, dead lettering",
+			"topic", t.Name,
+			"routing_key", routingKey,
+			"message_id", d.Envelope.ID,
+			"attempt", j.attempt,
+		)
+		s.metrics.Add(driver.MetricDeadLettered, t.Name)
+		s.deadLetter(j, err)
+		return
+	}
+
+	s.metrics.Add(driver.MetricRequeued, t.Name)
+	s.retry(ctx, j, policy.Backoff(j.attempt))
+}
+
+// ack acknowledges the message, even if we are shutting down part way through.
+func (s *subscription) ack(j job) {
+	if err := s.client.XAck(context.Background(), j.stream, s.group(), j.msg.ID).Err(); err != nil {
+		s.logger.Warn("redis acknowledgement unsuccessful", "stream", j.stream, "entry_id", j.msg.ID, "error", err)
+	}
+}
+
+// retry hands the message to the workers again after delay. It stays pending
+// with us meanwhile, so if we go away it is claimed by another consumer instead.
+// Claiming it again counts the attempt, and only succeeds if nobody else has.
+func (s *subscription) retry(ctx context.Context, j job, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		msgs, err := s.client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   j.stream,
+			Group:    s.group(),
+			Consumer: s.consumer,
+			MinIdle:  delay,
+			Messages: []string{j.msg.ID},
+		}).Result()
+		if err != nil || len(msgs) == 0 {
+			// claimed by someone else, trimmed away, or we are shutting down
+			return
+		}
+
+		j.attempt++
+		s.dispatch(ctx, j)
+	})
+}
+
+// deadLetter moves the message to our dead letter stream.
+func (s *subscription) deadLetter(j job, cause error) {
+	ctx := context.Background()
+
+	v := make(map[string]any, len(j.msg.Values)+1)
+	for k, val := range j.msg.Values {
+		v[k] = val
+	}
+	v[fieldError] = cause.Error()
+
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.deadLetterStream(),
+			MaxLen: s.cfg.MaxLen,
+			Approx: true,
+			Values: v,
+		})
+		p.XAck(ctx, j.stream, s.group(), j.msg.ID)
+		return nil
+	})
+	if err != nil {
+		// left pending, so it is claimed and tried again later rather than lost
+		s.logger.Error("redis unable to dead letter message", "stream", j.stream, "entry_id", j.msg.ID, "error", err)
+	}
+}
+
+var consumerSeq uint64
+
+// consumerName returns a consumer name unique to this process.
+func consumerName(name string) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%s-%d-%d", name, host, os.Getpid(), atomic.AddUint64(&consumerSeq, 1))
+}
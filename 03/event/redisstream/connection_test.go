@@ -0,0 +1,310 @@
+package redisstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	redis "github.com/go-redis/redis/v8"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+type message struct {
+	N int
+}
+
+var movieRelease = bus.NewTopic[message]("movie.release", "movie")
+
+// open starts a Redis stand-in and opens a bus on it, returning a client on it
+// too so tests can look at the streams.
+func open(t *testing.T) (*bus.Bus, *redis.Client) {
+	t.Helper()
+
+	m := miniredis.RunT(t)
+	b, err := bus.Open("redisstream", "redis://"+m.Addr()+"?name=svc&block=50ms&claim_min_idle=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return b, client
+}
+
+// subscribe subscribes in the background, returning once our consumer group is
+// on the movie stream. It is unsubscribed when the test finishes.
+func subscribe(t *testing.T, b *bus.Bus, client *redis.Client, opts driver.SubscribeOptions) {
+	t.Helper()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.SubscribeWithOptions(opts)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("subscribe: %v", err)
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		groups, _ := client.XInfoGroups(context.Background(), "movie").Result()
+		if len(groups) > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the consumer group")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitFor fails the test if ch isn't closed in time.
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// pending returns how many messages on the movie stream our group has yet to
+// acknowledge.
+func pending(t *testing.T, client *redis.Client) int64 {
+	t.Helper()
+
+	p, err := client.XPending(context.Background(), "movie", "svc").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Count
+}
+
+func TestPushSubscribe(t *testing.T) {
+	b, client := open(t)
+
+	var (
+		mu   sync.Mutex
+		got  = make(map[int]bool)
+		done = make(chan struct{})
+	)
+	err := bus.HandleEnvelope(b, movieRelease, func(ctx context.Context, env bus.Envelope, msg message) error {
+		if env.Topic != "movie.release" || env.RoutingKey != "movie.release" || env.ID == "" || env.Tenant != "acme" || env.Attempt != 1 {
+			t.Errorf("unexpected envelope %+v", env)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		got[msg.N] = true
+		if len(got) == 3 {
+			close(done)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, client, driver.SubscribeOptions{})
+
+	for i := 1; i <= 3; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}, bus.WithTenant("acme")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, done, "messages")
+
+	// acknowledged once consumed
+	deadline := time.Now().Add(5 * time.Second)
+	for pending(t, client) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("messages left pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	b, client := open(t)
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond}
+
+	var attempts []int
+	done := make(chan struct{})
+	err := bus.HandleEnvelope(b, topic, func(ctx context.Context, env bus.Envelope, msg message) error {
+		attempts = append(attempts, env.Attempt)
+		if env.Attempt < 3 {
+			return errors.New("not yet")
+		}
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, client, driver.SubscribeOptions{Workers: 1})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, done, "the third attempt")
+
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[1] != 2 || attempts[2] != 3 {
+		t.Fatalf("attempts %v, want [1 2 3]", attempts)
+	}
+}
+
+// A message left pending by a consumer that went away is claimed with
+// XAUTOCLAIM, once it has been idle long enough.
+func TestReclaim(t *testing.T) {
+	b, client := open(t)
+	ctx := context.Background()
+
+	// another instance of the service reads the message, then dies
+	if err := client.XGroupCreateMkStream(ctx, "movie", "svc", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(ctx, b, movieRelease, message{N: 7}); err != nil {
+		t.Fatal(err)
+	}
+	read, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "svc",
+		Consumer: "gone",
+		Streams:  []string{"movie", ">"},
+		Count:    1,
+	}).Result()
+	if err != nil || len(read) != 1 || len(read[0].Messages) != 1 {
+		t.Fatalf("read %v, %v", read, err)
+	}
+
+	envs := make(chan bus.Envelope, 1)
+	err = bus.HandleEnvelope(b, movieRelease, func(ctx context.Context, env bus.Envelope, msg message) error {
+		if msg.N != 7 {
+			t.Errorf("got %d, want 7", msg.N)
+		}
+		envs <- env
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, client, driver.SubscribeOptions{})
+
+	select {
+	case env := <-envs:
+		// delivered to the consumer that went away first
+		if env.Attempt != 2 || !env.Redelivered {
+			t.Fatalf("attempt %d redelivered %v, want 2 true", env.Attempt, env.Redelivered)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message to be claimed")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pending(t, client) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("claimed message left pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	b, client := open(t)
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 2, Delay: time.Millisecond}
+
+	var attempts int32
+	err := bus.Handle(b, topic, func(ctx context.Context, msg message) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("never")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, client, driver.SubscribeOptions{Workers: 1})
+
+	if err := bus.Publish(context.Background(), b, topic, message{N: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var dead []redis.XMessage
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dead) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the message to be dead lettered")
+		}
+		time.Sleep(time.Millisecond)
+		dead, _ = client.XRange(context.Background(), "svc.dead", "-", "+").Result()
+	}
+
+	if len(dead) != 1 {
+		t.Fatalf("%d dead letters, want 1", len(dead))
+	}
+	if got := field(dead[0], fieldError); got != "never" {
+		t.Fatalf("dead lettered with error %q, want never", got)
+	}
+	if got := field(dead[0], fieldRoutingKey); got != "movie.release" {
+		t.Fatalf("dead lettered with routing key %q", got)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("consumed %d times, want 2", n)
+	}
+	if n := pending(t, client); n != 0 {
+		t.Fatalf("%d messages left pending", n)
+	}
+}
+
+// Every subscription has a consumer of its own, which is deleted when it stops.
+func TestUnsubscribeRemovesConsumer(t *testing.T) {
+	b, client := open(t)
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, client, driver.SubscribeOptions{})
+
+	consumers := func() int {
+		// by hand, go-redis v8 can't read the reply without idle times
+		res, err := client.Do(ctx, "xinfo", "consumers", "movie", "svc").Slice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res)
+	}
+
+	if err := bus.Publish(ctx, b, movieRelease, message{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, done, "the message")
+	if n := consumers(); n != 1 {
+		t.Fatalf("%d consumers, want 1", n)
+	}
+
+	if err := b.Unsubscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := consumers(); n != 0 {
+		t.Fatalf("%d consumers left after unsubscribing, want 0", n)
+	}
+}
@@ -0,0 +1,67 @@
+package redisstream
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	redis "github.com/go-redis/redis/v8"
+)
+
+// connector holds the Redis client, which pools its own connections, shared by
+// every driver.Conn handed out.
+type connector struct {
+	cfg     config
+	client  *redis.Client
+	metrics driver.Metrics
+	logger  driver.Logger
+}
+
+func newConnector(cfg config) *connector {
+	return &connector{
+		cfg:     cfg,
+		client:  redis.NewClient(cfg.Redis),
+		metrics: driver.NopMetrics{},
+		logger:  driver.StdLogger{},
+	}
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	consumeCtx, stop := driver.ConsumeContext(ctx)
+	return &conn{
+		cfg:         c.cfg,
+		client:      c.client,
+		metrics:     c.metrics,
+		logger:      c.logger,
+		consumeCtx:  consumeCtx,
+		stopConsume: stop,
+	}, nil
+}
+
+// SetMetrics implements driver.ConnectorMetrics.
+func (c *connector) SetMetrics(m driver.Metrics) {
+	c.metrics = m
+}
+
+// SetLogger implements driver.ConnectorLogger.
+func (c *connector) SetLogger(l driver.Logger) {
+	c.logger = l
+}
+
+// open pings Redis, so a bad configuration is reported straight away.
+func (c *connector) open() error {
+	if err := c.client.Ping(context.Background()).Err(); err != nil {
+		c.client.Close()
+		return fmt.Errorf("unable to connect to redis: %w", err)
+	}
+	return nil
+}
+
+// Close closes the client, and with it every connection in its pool.
+func (c *connector) Close() error {
+	return c.client.Close()
+}
+
+func (c *connector) Driver() driver.Driver {
+	return BusDriver{}
+}
@@ -0,0 +1,53 @@
+// Package redisstream provides the implementation of the bus/driver interface on
+// Redis Streams: https://redis.io/docs/data-types/streams/
+//
+// Each exchange is a stream, and each service reads it through a consumer group
+// named after the service, so running more than one instance shares the messages
+// between them the same as a rabbit queue. Messages stay pending in the group
+// until they are consumed successfully, and anything left pending by a consumer
+// that crashed is claimed by another with XAUTOCLAIM. Consumers are deleted from
+// the group once they have nothing pending, as each subscription has a new one.
+//
+// Streams can't hold on to messages for later, so delayed pushes are left to the
+// bus' scheduler, see bus.SetScheduler.
+package redisstream
+
+import (
+	"fmt"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+type BusDriver struct{}
+
+// OpenConnector always fails, there is no default service name, see
+// OpenConnectorDSN.
+func (d BusDriver) OpenConnector() (driver.Connector, error) {
+	return d.OpenConnectorDSN("")
+}
+
+// OpenConnectorDSN opens a connection to Redis configured by dsn, see ParseDSN for
+// its format.
+func (d BusDriver) OpenConnectorDSN(dsn string) (driver.Connector, error) {
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("bus name variable is not set, each service needs this set in order to create a consumer group")
+	}
+
+	conn := newConnector(cfg)
+
+	// ping to ensure it works
+	if err := conn.open(); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func init() {
+	bus.Register("redisstream", &BusDriver{})
+}
@@ -0,0 +1,15 @@
+package redisstream
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNameRequired(t *testing.T) {
+	for _, dsn := range []string{"", "redis://localhost:6379/0"} {
+		_, err := (BusDriver{}).OpenConnectorDSN(dsn)
+		if err == nil || !strings.Contains(err.Error(), "bus name") {
+			t.Errorf("OpenConnectorDSN(%q) = %v, want the name to be required", dsn, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package redisstream
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+type config struct {
+	Redis *redis.Options
+	Name  string
+
+	// Prefix is put in front of every stream and group name, so environments can
+	// share a server.
+	Prefix string
+
+	// Workers is the default number of messages consumed at once by a
+	// subscription, it is also how many are read at a time.
+	Workers int
+
+	// MaxLen trims the streams to roughly this many messages as they are pushed
+	// onto. Zero doesn't trim.
+	MaxLen int64
+
+	// ClaimMinIdle is how long a message can be pending with a consumer before
+	// it is assumed to have crashed, and the message is claimed by another. It
+	// must be longer than a consumer takes, including the longest retry delay.
+	ClaimMinIdle time.Duration
+
+	// Block is how long a read waits for messages before asking again, and so
+	// how long unsubscribing can take.
+	Block time.Duration
+}
+
+func NewConfig() config {
+	return config{
+		Redis:        &redis.Options{Addr: "localhost:6379"},
+		Workers:      10,
+		MaxLen:       100000,
+		ClaimMinIdle: 5 * time.Minute,
+		Block:        2 * time.Second,
+	}
+}
+
+// ParseDSN parses a data source name of the form
+//
+//	redis://:password@host:6379/0?name=svc&prefix=dev_&max_len=100000
+//
+// into a config. Anything left out keeps its NewConfig default, an empty DSN is
+// just the defaults. Use the rediss scheme for TLS. Other than the options
+// go-redis takes in a URL, the query parameters are:
+//
+//	name            service name, used for the consumer group (required)
+//	prefix          prefix for every stream and group
+//	workers         messages consumed at once
+//	max_len         approximate length streams are trimmed to, 0 to not trim
+//	claim_min_idle  how long before a pending message is claimed, e.g. 5m
+//	block           how long a read waits for messages, e.g. 2s
+func ParseDSN(dsn string) (config, error) {
+	cfg := NewConfig()
+	if dsn == "" {
+		return cfg, nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return cfg, fmt.Errorf("redisstream: invalid dsn: %w", err)
+	}
+
+	// take our parameters out, go-redis complains about any it doesn't know
+	q := u.Query()
+	take := func(key string) string {
+		v := q.Get(key)
+		q.Del(key)
+		return v
+	}
+
+	if v := take("name"); v != "" {
+		cfg.Name = v
+	}
+	cfg.Prefix = take("prefix")
+	if v := take("workers"); v != "" {
+		if cfg.Workers, err = strconv.Atoi(v); err != nil {
+			return cfg, fmt.Errorf("redisstream: invalid workers %q: %w", v, err)
+		}
+	}
+	if v := take("max_len"); v != "" {
+		if cfg.MaxLen, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return cfg, fmt.Errorf("redisstream: invalid max_len %q: %w", v, err)
+		}
+	}
+	if v := take("claim_min_idle"); v != "" {
+		if cfg.ClaimMinIdle, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("redisstream: invalid claim_min_idle %q: %w", v, err)
+		}
+	}
+	if v := take("block"); v != "" {
+		if cfg.Block, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("redisstream: invalid block %q: %w", v, err)
+		}
+	}
+
+	u.RawQuery = q.Encode()
+	if cfg.Redis, err = redis.ParseURL(u.String()); err != nil {
+		return cfg, fmt.Errorf("redisstream: invalid dsn: %w", err)
+	}
+
+	return cfg, nil
+}
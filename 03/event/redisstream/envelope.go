@@ -0,0 +1,82 @@
+package redisstream
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+	redis "github.com/go-redis/redis/v8"
+)
+
+// the fields of a stream entry
+const (
+	fieldID            = "id"
+	fieldCorrelationID = "correlation_id"
+	fieldCausationID   = "causation_id"
+	fieldTenant        = "tenant"
+	fieldTimestamp     = "timestamp"
+	fieldRoutingKey    = "routing_key"
+	fieldContentType   = "content_type"
+	fieldHeaders       = "headers"
+	fieldReplyTo       = "reply_to"
+	fieldBody          = "body"
+	// fieldError holds why the message was dead lettered.
+	fieldError = "error"
+)
+
+// values builds the fields of the stream entry for a message.
+func values(env driver.Envelope, contentType string, body []byte) (map[string]any, error) {
+	v := map[string]any{
+		fieldID:            env.ID,
+		fieldCorrelationID: env.CorrelationID,
+		fieldCausationID:   env.CausationID,
+		fieldTenant:        env.Tenant,
+		fieldTimestamp:     env.Timestamp.Format(time.RFC3339Nano),
+		fieldRoutingKey:    env.RoutingKey,
+		fieldContentType:   contentType,
+		fieldBody:          body,
+	}
+
+	if env.ReplyTo != "" {
+		v[fieldReplyTo] = env.ReplyTo
+	}
+	if len(env.Headers) > 0 {
+		h, err := json.Marshal(env.Headers)
+		if err != nil {
+			return nil, err
+		}
+		v[fieldHeaders] = string(h)
+	}
+	return v, nil
+}
+
+// delivery builds what is passed to the topic consumer for a stream entry.
+func delivery(msg redis.XMessage, t driver.Topic, attempt int) driver.Delivery {
+	env := driver.Envelope{
+		ID:            field(msg, fieldID),
+		CorrelationID: field(msg, fieldCorrelationID),
+		CausationID:   field(msg, fieldCausationID),
+		Tenant:        field(msg, fieldTenant),
+		Redelivered:   attempt > 1,
+		Attempt:       attempt,
+		Topic:         t.Name,
+		RoutingKey:    field(msg, fieldRoutingKey),
+		ReplyTo:       field(msg, fieldReplyTo),
+	}
+	env.Timestamp, _ = time.Parse(time.RFC3339Nano, field(msg, fieldTimestamp))
+
+	if h := field(msg, fieldHeaders); h != "" {
+		_ = json.Unmarshal([]byte(h), &env.Headers)
+	}
+
+	return driver.Delivery{
+		Envelope:    env,
+		ContentType: field(msg, fieldContentType),
+		Body:        []byte(field(msg, fieldBody)),
+	}
+}
+
+func field(msg redis.XMessage, name string) string {
+	s, _ := msg.Values[name].(string)
+	return s
+}
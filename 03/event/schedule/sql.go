@@ -0,0 +1,200 @@
+// Package schedule provides stores for the bus' scheduler, see bus.SetScheduler.
+// They hold messages pushed with PushAt until they are due, for drivers that
+// can't hold on to them themselves.
+//
+//	store, err := schedule.NewSQL(db, schedule.Postgres, "")
+//	eb.SetScheduler(store)
+//	go eb.RunScheduler(ctx)
+package schedule
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/internal/sqldialect"
+)
+
+// Dialect is the flavour of SQL spoken by the database.
+type Dialect = sqldialect.Dialect
+
+const (
+	Postgres = sqldialect.Postgres
+	SQLite   = sqldialect.SQLite
+)
+
+// DefaultTable is the table used when NewSQL is given no table name.
+const DefaultTable = "bus_scheduled"
+
+// SQLStore is a schedule store on a table in a database. Messages are deleted
+// once they have been pushed.
+//
+// On Postgres schedulers skip the messages another is busy leasing. SQLite
+// doesn't lock on reading, so two schedulers may both push a message, which at
+// least once delivery allows for anyway.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+}
+
+// NewSQL returns a store on the table in db, creating the table if it doesn't
+// exist. An empty table name uses DefaultTable.
+func NewSQL(db *sql.DB, dialect Dialect, table string) (*SQLStore, error) {
+	if table == "" {
+		table = DefaultTable
+	}
+	// it goes straight into the SQL
+	if !sqldialect.ValidIdentifier(table) {
+		return nil, fmt.Errorf("schedule: invalid table %q", table)
+	}
+
+	s := &SQLStore{db: db, dialect: dialect, table: table}
+	if err := s.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Schedule stores the message. A message scheduled again with the same ID is
+// left as it was.
+func (s *SQLStore) Schedule(ctx context.Context, msg bus.Scheduled) error {
+	headers := ""
+	if len(msg.Envelope.Headers) > 0 {
+		h, err := json.Marshal(msg.Envelope.Headers)
+		if err != nil {
+			return err
+		}
+		headers = string(h)
+	}
+
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(`INSERT INTO `+s.table+` (message_id, topic, exchange,
+routing_key, correlation_id, causation_id, tenant, headers, content_type, body, created_at, due_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (message_id) DO NOTHING`),
+		msg.Envelope.ID,
+		msg.Topic,
+		msg.Exchange,
+		msg.Envelope.RoutingKey,
+		msg.Envelope.CorrelationID,
+		msg.Envelope.CausationID,
+		msg.Envelope.Tenant,
+		headers,
+		msg.ContentType,
+		msg.Body,
+		msg.Envelope.Timestamp.UnixMilli(),
+		msg.At.UnixMilli(),
+	)
+	return err
+}
+
+// Due returns the messages due by now, earliest first, leasing them.
+func (s *SQLStore) Due(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]bus.Scheduled, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	lock := ""
+	if s.dialect == Postgres {
+		lock = " FOR UPDATE SKIP LOCKED"
+	}
+	rows, err := tx.QueryContext(ctx, s.dialect.Rebind(`SELECT message_id, topic, exchange, routing_key,
+correlation_id, causation_id, tenant, headers, content_type, body, created_at, due_at
+FROM `+s.table+` WHERE due_at <= ? AND (locked_until IS NULL OR locked_until <= ?)
+ORDER BY due_at LIMIT ?`+lock), now.UnixMilli(), now.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var due []bus.Scheduled
+	for rows.Next() {
+		var (
+			msg              bus.Scheduled
+			headers          string
+			createdAt, dueAt int64
+		)
+		err := rows.Scan(
+			&msg.Envelope.ID,
+			&msg.Topic,
+			&msg.Exchange,
+			&msg.Envelope.RoutingKey,
+			&msg.Envelope.CorrelationID,
+			&msg.Envelope.CausationID,
+			&msg.Envelope.Tenant,
+			&headers,
+			&msg.ContentType,
+			&msg.Body,
+			&createdAt,
+			&dueAt,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if headers != "" {
+			if err := json.Unmarshal([]byte(headers), &msg.Envelope.Headers); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("unable to decode headers of message %s: %w", msg.Envelope.ID, err)
+			}
+		}
+		msg.Envelope.Timestamp = time.UnixMilli(createdAt)
+		msg.At = time.UnixMilli(dueAt)
+		due = append(due, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	leaseUntil := s.dialect.Rebind(`UPDATE ` + s.table + ` SET locked_until = ? WHERE message_id = ?`)
+	for _, msg := range due {
+		if _, err := tx.ExecContext(ctx, leaseUntil, now.Add(lease).UnixMilli(), msg.Envelope.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return due, nil
+}
+
+// Done deletes the message.
+func (s *SQLStore) Done(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(`DELETE FROM `+s.table+` WHERE message_id = ?`), id)
+	return err
+}
+
+// migrate creates the table if it doesn't exist. Times are stored as unix
+// milliseconds, so they compare the same on every database.
+func (s *SQLStore) migrate(ctx context.Context) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+	message_id     TEXT PRIMARY KEY,
+	topic          TEXT NOT NULL,
+	exchange       TEXT NOT NULL,
+	routing_key    TEXT NOT NULL,
+	correlation_id TEXT NOT NULL,
+	causation_id   TEXT NOT NULL,
+	tenant         TEXT NOT NULL,
+	headers        TEXT NOT NULL,
+	content_type   TEXT NOT NULL,
+	body           ` + s.dialect.Blob() + `,
+	created_at     BIGINT NOT NULL,
+	due_at         BIGINT NOT NULL,
+	locked_until   BIGINT
+)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.table + `_due ON ` + s.table + ` (due_at)`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("unable to create schedule table: %w", err)
+		}
+	}
+	return nil
+}
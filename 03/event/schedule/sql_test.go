@@ -0,0 +1,150 @@
+package schedule
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+)
+
+// newStore returns a store on a SQLite database of the test's own.
+func newStore(t *testing.T) *SQLStore {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "schedule.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s, err := NewSQL(db, SQLite, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func scheduled(id string, at time.Time) bus.Scheduled {
+	return bus.Scheduled{
+		Topic:    "movie.release",
+		Exchange: "movie",
+		Envelope: bus.Envelope{
+			ID:            id,
+			RoutingKey:    "movie.release.drama",
+			CorrelationID: "corr",
+			CausationID:   "cause",
+			Tenant:        "acme",
+			Headers:       map[string]string{"traceparent": "00-abc"},
+			Timestamp:     time.UnixMilli(time.Now().UnixMilli()),
+		},
+		ContentType: "application/json",
+		Body:        []byte(`{"N":1}`),
+		At:          time.UnixMilli(at.UnixMilli()),
+	}
+}
+
+// ids returns the IDs of the messages due.
+func ids(t *testing.T, s *SQLStore, now time.Time, lease time.Duration) []string {
+	t.Helper()
+
+	due, err := s.Due(context.Background(), now, 10, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, msg := range due {
+		ids = append(ids, msg.Envelope.ID)
+	}
+	return ids
+}
+
+func TestDue(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	past := scheduled("past", now.Add(-time.Minute))
+	for _, msg := range []bus.Scheduled{past, scheduled("future", now.Add(time.Hour))} {
+		if err := s.Schedule(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	due, err := s.Due(ctx, now, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 {
+		t.Fatalf("%d messages due, want 1", len(due))
+	}
+	got := due[0]
+	if got.Topic != past.Topic || got.Exchange != past.Exchange || got.ContentType != past.ContentType ||
+		string(got.Body) != string(past.Body) || !got.At.Equal(past.At) {
+		t.Errorf("got %+v, want %+v", got, past)
+	}
+	env := got.Envelope
+	if env.ID != "past" || env.RoutingKey != past.Envelope.RoutingKey || env.CorrelationID != "corr" ||
+		env.CausationID != "cause" || env.Tenant != "acme" || env.Headers["traceparent"] != "00-abc" ||
+		!env.Timestamp.Equal(past.Envelope.Timestamp) {
+		t.Errorf("got envelope %+v, want %+v", env, past.Envelope)
+	}
+
+	// leased, so not due again until the lease runs out
+	if got := ids(t, s, now, time.Minute); len(got) != 0 {
+		t.Fatalf("leased messages due again: %v", got)
+	}
+	if got := ids(t, s, now.Add(time.Minute+time.Millisecond), time.Minute); len(got) != 1 || got[0] != "past" {
+		t.Fatalf("got %v due once the lease ran out, want [past]", got)
+	}
+
+	if err := s.Done(ctx, "past"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(t, s, now.Add(2*time.Hour), time.Minute); len(got) != 1 || got[0] != "future" {
+		t.Fatalf("got %v due later, want [future]", got)
+	}
+}
+
+func TestDueEarliestFirst(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	for _, msg := range []bus.Scheduled{
+		scheduled("c", now.Add(-time.Second)),
+		scheduled("a", now.Add(-3*time.Second)),
+		scheduled("b", now.Add(-2*time.Second)),
+	} {
+		if err := s.Schedule(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := ids(t, s, now, time.Minute)
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("got %v, want [a b c]", got)
+	}
+}
+
+// Scheduling a message again, such as on retrying PushAt, leaves it as it was.
+func TestScheduleTwice(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	if err := s.Schedule(ctx, scheduled("m", now.Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Schedule(ctx, scheduled("m", now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ids(t, s, now, time.Minute); len(got) != 1 || got[0] != "m" {
+		t.Fatalf("got %v, want [m] due when first scheduled", got)
+	}
+}
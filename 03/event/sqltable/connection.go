@@ -0,0 +1,471 @@
+package sqltable
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// cleanupInterval is how often a subscription deletes consumed events older than
+// the retention.
+const cleanupInterval = 10 * time.Minute
+
+type conn struct {
+	cfg     config
+	db      *sql.DB
+	q       queries
+	metrics driver.Metrics
+	logger  driver.Logger
+
+	consumeCtx  context.Context
+	stopConsume context.CancelFunc
+}
+
+// job is a delivery claimed for a worker.
+type job struct {
+	id      int64
+	attempt int
+	claimed time.Time
+	event   event
+}
+
+// event is a row of the events table.
+type event struct {
+	id          int64
+	exchange    string
+	env         driver.Envelope
+	contentType string
+	body        []byte
+	// err is why the event couldn't be read as it was pushed
+	err error
+}
+
+// slots are the deliveries a subscription can take on at once, one for each
+// worker and for each message its lanes hold. A slot is taken for every delivery
+// claimed and put back once it is settled, so deliveries aren't claimed only to
+// wait for a worker while their lease runs out.
+type slots chan struct{}
+
+// take waits for a free slot, then takes up to n, returning how many it took. It
+// returns 0 once ctx is done.
+func (s slots) take(ctx context.Context, n int) int {
+	select {
+	case s <- struct{}{}:
+	case <-ctx.Done():
+		return 0
+	}
+
+	taken := 1
+	for taken < n {
+		select {
+		case s <- struct{}{}:
+			taken++
+		default:
+			return taken
+		}
+	}
+	return taken
+}
+
+// put frees n slots.
+func (s slots) put(n int) {
+	for i := 0; i < n; i++ {
+		<-s
+	}
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (c *conn) Push(ctx context.Context, topic driver.Topic, m driver.Message) error {
+	return c.PushEnvelope(ctx, topic, driver.Envelope{Timestamp: time.Now()}, m)
+}
+
+func (c *conn) PushEnvelope(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := c.insert(ctx, tx, topic, env, m, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PushAt implements driver.ConnPushAt, the deliveries aren't available to claim
+// until at.
+func (c *conn) PushAt(ctx context.Context, topic driver.Topic, env driver.Envelope, m driver.Message, at time.Time) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := c.insert(ctx, tx, topic, env, m, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insert stores the message and a delivery, available from the given time, for
+// every service subscribed to the topic's exchange.
+func (c *conn) insert(ctx context.Context, ex execer, topic driver.Topic, env driver.Envelope, m driver.Message, available time.Time) error {
+	if env.RoutingKey == "" {
+		env.RoutingKey = topic.Name
+	}
+
+	body, err := topic.Codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	headers := ""
+	if len(env.Headers) > 0 {
+		h, err := json.Marshal(env.Headers)
+		if err != nil {
+			return err
+		}
+		headers = string(h)
+	}
+
+	var id int64
+	err = ex.QueryRowContext(ctx, c.q.insertEvent,
+		topic.Exchange,
+		env.RoutingKey,
+		env.ID,
+		env.CorrelationID,
+		env.CausationID,
+		env.Tenant,
+		headers,
+		topic.Codec.ContentType(),
+		body,
+		env.Timestamp.UnixMilli(),
+	).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("unable to insert event: %w", err)
+	}
+
+	_, err = ex.ExecContext(ctx, c.q.fanOut, id, available.UnixMilli(), topic.Exchange)
+	if err != nil {
+		return fmt.Errorf("unable to insert deliveries: %w", err)
+	}
+	return nil
+}
+
+func (c *conn) Subscribe(ctx context.Context, topics []driver.Topic) error {
+	return c.SubscribeWithOptions(ctx, topics, driver.SubscribeOptions{})
+}
+
+func (c *conn) SubscribeWithOptions(ctx context.Context, topics []driver.Topic, opts driver.SubscribeOptions) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = c.cfg.Workers
+	}
+
+	// subscribe the service to every exchange, messages pushed from now on get a
+	// delivery for us, the same as binding a queue
+	byExchange := make(map[string][]driver.Topic)
+	for _, t := range topics {
+		if _, ok := byExchange[t.Exchange]; !ok {
+			if _, err := c.db.ExecContext(ctx, c.q.subscribe, c.cfg.Name, t.Exchange); err != nil {
+				return fmt.Errorf("unable to subscribe to exchange %q: %w", t.Exchange, err)
+			}
+		}
+		byExchange[t.Exchange] = append(byExchange[t.Exchange], t)
+	}
+
+	// topics with a concurrency of their own are consumed in lanes, so they don't
+	// hold up the workers
+	lanes := driver.NewLanes(topics, workers)
+	free := make(slots, workers+lanes.Held())
+
+	queue := make(chan job)
+	var inflight sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			for j := range queue {
+				c.handle(j, byExchange[j.event.exchange], lanes, free)
+			}
+		}()
+	}
+
+	c.poll(ctx, free, queue)
+
+	close(queue)
+	inflight.Wait()
+	lanes.Close()
+	return nil
+}
+
+// poll claims as many deliveries as there are free slots for, handing them to
+// the workers, until ctx is done.
+func (c *conn) poll(ctx context.Context, free slots, queue chan<- job) {
+	lastCleanup := time.Now()
+
+	for {
+		n := free.take(ctx, cap(free))
+		if n == 0 {
+			return
+		}
+
+		jobs, err := c.claim(ctx, n)
+		if err != nil && ctx.Err() == nil {
+			c.logger.Warn("sql bus unable to claim deliveries", "error", err)
+		}
+		free.put(n - len(jobs))
+
+		for i, j := range jobs {
+			select {
+			case queue <- j:
+			case <-ctx.Done():
+				// hand back what we claimed but never started on
+				for _, j := range jobs[i:] {
+					c.exec(c.q.release, j.id)
+				}
+				free.put(len(jobs) - i)
+				return
+			}
+		}
+
+		if time.Since(lastCleanup) > cleanupInterval {
+			lastCleanup = time.Now()
+			c.exec(c.q.cleanup, time.Now().Add(-c.cfg.Retention).UnixMilli())
+		}
+
+		// a full batch means there is probably more waiting
+		if err == nil && len(jobs) == n {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.cfg.PollInterval):
+		}
+	}
+}
+
+// claim leases up to n deliveries ready for us, and loads their events.
+func (c *conn) claim(ctx context.Context, n int) ([]job, error) {
+	now := time.Now()
+	rows, err := c.db.QueryContext(ctx, c.q.claim,
+		now.Add(c.cfg.Lease).UnixMilli(),
+		c.cfg.Name,
+		now.UnixMilli(),
+		now.UnixMilli(),
+		n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []job
+	var eventIDs []any
+	for rows.Next() {
+		j := job{claimed: now}
+		if err := rows.Scan(&j.id, &j.event.id, &j.attempt); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+		eventIDs = append(eventIDs, j.event.id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+
+	events, err := c.events(ctx, eventIDs)
+	if err != nil {
+		// hand them back, such as when stopping part way through claiming
+		for _, j := range jobs {
+			c.exec(c.q.release, j.id)
+		}
+		return nil, err
+	}
+	for i := range jobs {
+		jobs[i].event = events[jobs[i].event.id]
+	}
+	return jobs, nil
+}
+
+func (c *conn) events(ctx context.Context, ids []any) (map[int64]event, error) {
+	rows, err := c.db.QueryContext(ctx, c.q.eventsIn(len(ids)), ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make(map[int64]event, len(ids))
+	for rows.Next() {
+		var (
+			e         event
+			headers   string
+			createdAt int64
+		)
+		err := rows.Scan(
+			&e.id,
+			&e.exchange,
+			&e.env.RoutingKey,
+			&e.env.ID,
+			&e.env.CorrelationID,
+			&e.env.CausationID,
+			&e.env.Tenant,
+			&headers,
+			&e.contentType,
+			&e.body,
+			&createdAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if headers != "" {
+			if err := json.Unmarshal([]byte(headers), &e.env.Headers); err != nil {
+				e.err = fmt.Errorf("invalid headers: %w", err)
+			}
+		}
+		e.env.Timestamp = time.UnixMilli(createdAt)
+		events[e.id] = e
+	}
+	return events, rows.Err()
+}
+
+// handle passes a delivery to the matching topic consumer, in the topic's lane if
+// it has one, freeing its slot once it is settled.
+func (c *conn) handle(j job, topics []driver.Topic, lanes *driver.Lanes, free slots) {
+	env := j.event.env
+
+	t, ok := driver.MatchTopic(topics, env.RoutingKey)
+	if !ok {
+		// we get a delivery for everything on the exchange, this one is for none
+		// of our topics
+		c.exec(c.q.ack, j.id)
+		free.put(1)
+		return
+	}
+
+	lanes.Do(t, func() {
+		defer free.put(1)
+
+		// it may have waited in the lane, so make sure the lease outlasts the
+		// consumer, if it's still ours
+		if time.Since(j.claimed) > c.cfg.Lease/2 && !c.extend(j) {
+			return
+		}
+		c.consume(j, t, env)
+	})
+}
+
+// extend renews the lease on a delivery, reporting whether it is still ours. Its
+// lease may have run out and another instance claimed it since.
+func (c *conn) extend(j job) bool {
+	res, err := c.db.ExecContext(context.Background(), c.q.extend,
+		time.Now().Add(c.cfg.Lease).UnixMilli(),
+		j.id,
+		j.attempt,
+	)
+	var n int64
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	if err != nil {
+		// leave it for the lease to run out, rather than risk consuming it twice
+		c.logger.Warn("sql bus unable to extend lease", "message_id", j.event.env.ID, "error", err)
+		return false
+	}
+	if n == 0 {
+		c.logger.Warn("sql bus lease ran out before consuming, leaving the delivery to whoever claimed it",
+			"message_id", j.event.env.ID,
+			"attempt", j.attempt,
+		)
+		return false
+	}
+	return true
+}
+
+// consume passes a delivery to the topic's consumer, deleting it on success.
+func (c *conn) consume(j job, t driver.Topic, env driver.Envelope) {
+	env.Topic = t.Name
+	env.Attempt = j.attempt
+	env.Redelivered = j.attempt > 1
+
+	if j.event.err != nil {
+		// retrying won't make it readable
+		c.logger.Error("unable to read message, dead lettering",
+			"topic", t.Name,
+			"message_id", env.ID,
+			"event_id", j.event.id,
+			"error", j.event.err,
+		)
+		c.metrics.Add(driver.MetricDeadLettered, t.Name)
+		c.exec(c.q.dead, j.event.err.Error(), j.id)
+		return
+	}
+
+	err := t.Consumer(c.consumeCtx, driver.Delivery{
+		Envelope:    env,
+		ContentType: j.event.contentType,
+		Body:        j.event.body,
+	})
+	if err == nil {
+		c.exec(c.q.ack, j.id)
+		return
+	}
+
+	c.logger.Warn("consumer had an issue processing an event message",
+		"topic", t.Name,
+		"routing_key", env.RoutingKey,
+		"message_id", env.ID,
+		"attempt", j.attempt,
+		"payload", j.event.body,
+		"error", err,
+	)
+
+	policy := t.RetryPolicy()
+	if j.attempt >= policy.MaxAttempts {
+		// left in the table, marked dead, for someone to look at
+		c.logger.Error("message failed too many times, dead lettering",
+			"topic", t.Name,
+			"routing_key", env.RoutingKey,
+			"message_id", env.ID,
+			"attempt", j.attempt,
+		)
+		c.metrics.Add(driver.MetricDeadLettered, t.Name)
+		c.exec(c.q.dead, err.Error(), j.id)
+		return
+	}
+
+	c.metrics.Add(driver.MetricRequeued, t.Name)
+
+	c.exec(c.q.retry, time.Now().Add(policy.Backoff(j.attempt)).UnixMilli(), err.Error(), j.id)
+}
+
+// exec runs a statement settling a delivery. It isn't tied to the subscription's
+// context, so deliveries are still settled while shutting down. If it fails the
+// delivery is retried once its lease runs out.
+func (c *conn) exec(query string, args ...any) {
+	if _, err := c.db.ExecContext(context.Background(), query, args...); err != nil {
+		c.logger.Warn("sql bus unable to update delivery", "error", err)
+	}
+}
+
+// Close cancels the context of any consumers still running. The database is
+// shared and owned by the connector, so is left open.
+func (c *conn) Close() error {
+	c.stopConsume()
+	return nil
+}
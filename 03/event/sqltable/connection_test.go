@@ -0,0 +1,474 @@
+package sqltable
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+type message struct {
+	N int
+}
+
+var movieRelease = bus.NewTopic[message]("movie.release", "movie")
+
+// newDSN returns the DSN of a SQLite database of the test's own, and the
+// database opened on it so tests can look at the tables.
+func newDSN(t *testing.T, options string) (string, *sql.DB) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "bus.db")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	dsn := "sqlite3://" + path + "?name=svc&poll_interval=10ms"
+	if options != "" {
+		dsn += "&" + options
+	}
+	return dsn, db
+}
+
+// open opens a bus on the database.
+func open(t *testing.T, dsn string) *bus.Bus {
+	t.Helper()
+
+	b, err := bus.Open("sql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// subscribe subscribes in the background, returning once we are subscribed to
+// the movie exchange. It is unsubscribed when the test finishes, if it hasn't
+// been.
+func subscribe(t *testing.T, b *bus.Bus, db *sql.DB, opts driver.SubscribeOptions) {
+	t.Helper()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.SubscribeWithOptions(opts)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("subscribe: %v", err)
+		}
+	})
+
+	waitUntil(t, "the subscription", func() bool {
+		var n int
+		db.QueryRow(`SELECT COUNT(*) FROM bus_events_subscriptions WHERE exchange = 'movie'`).Scan(&n)
+		return n > 0
+	})
+}
+
+// subscribeGroup subscribes the service to the movie exchange without consuming,
+// so pushes get a delivery for it.
+func subscribeGroup(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	if _, err := db.Exec(`INSERT INTO bus_events_subscriptions (group_name, exchange) VALUES ('svc', 'movie')`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitUntil fails the test if f isn't true in time.
+func waitUntil(t *testing.T, what string, f func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// deliveries returns how many deliveries are left.
+func deliveries(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM bus_events_deliveries`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPushSubscribe(t *testing.T) {
+	dsn, db := newDSN(t, "")
+	b := open(t, dsn)
+
+	var (
+		mu   sync.Mutex
+		got  = map[int]bus.Envelope{}
+		done = make(chan struct{})
+	)
+	err := bus.HandleEnvelope(b, movieRelease, func(ctx context.Context, env bus.Envelope, msg message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got[msg.N] = env
+		if len(got) == 3 {
+			close(done)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, db, driver.SubscribeOptions{})
+
+	for i := 1; i <= 3; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}, bus.WithHeader("x-n", "yes")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for messages")
+	}
+
+	mu.Lock()
+	for i := 1; i <= 3; i++ {
+		env, ok := got[i]
+		if !ok {
+			t.Fatalf("message %d not consumed", i)
+		}
+		if env.Topic != "movie.release" || env.RoutingKey != "movie.release" || env.ID == "" || env.Attempt != 1 || env.Headers["x-n"] != "yes" {
+			t.Errorf("unexpected envelope %+v", env)
+		}
+	}
+	mu.Unlock()
+
+	waitUntil(t, "the deliveries to be deleted", func() bool { return deliveries(t, db) == 0 })
+}
+
+func TestRetry(t *testing.T) {
+	dsn, db := newDSN(t, "")
+	b := open(t, dsn)
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond}
+
+	done := make(chan struct{})
+	err := bus.HandleEnvelope(b, topic, func(ctx context.Context, env bus.Envelope, msg message) error {
+		if env.Attempt < 3 {
+			return errors.New("not yet")
+		}
+		if !env.Redelivered {
+			t.Error("retry not marked redelivered")
+		}
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, db, driver.SubscribeOptions{})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the third attempt")
+	}
+	waitUntil(t, "the delivery to be deleted", func() bool { return deliveries(t, db) == 0 })
+}
+
+func TestDeadLetter(t *testing.T) {
+	dsn, db := newDSN(t, "")
+	b := open(t, dsn)
+
+	topic := movieRelease
+	topic.Retry = driver.RetryPolicy{MaxAttempts: 2, Delay: time.Millisecond}
+
+	var attempts int32
+	err := bus.Handle(b, topic, func(ctx context.Context, msg message) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("never")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, db, driver.SubscribeOptions{})
+
+	if err := bus.Publish(context.Background(), b, topic, message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		attempt   int
+		lastError string
+	)
+	waitUntil(t, "the message to be dead lettered", func() bool {
+		err := db.QueryRow(`SELECT attempt, last_error FROM bus_events_deliveries WHERE dead`).Scan(&attempt, &lastError)
+		return err == nil
+	})
+	if attempt != 2 || lastError != "never" {
+		t.Fatalf("dead lettered on attempt %d with error %q, want 2 never", attempt, lastError)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("consumed %d times, want 2", n)
+	}
+}
+
+// A message whose headers can't be read is dead lettered, rather than consumed
+// without them.
+func TestCorruptHeaders(t *testing.T) {
+	dsn, db := newDSN(t, "")
+	b := open(t, dsn)
+	subscribeGroup(t, db)
+
+	var consumed int32
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		atomic.AddInt32(&consumed, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bus.Publish(context.Background(), b, movieRelease, message{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE bus_events SET headers = '{'`); err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, db, driver.SubscribeOptions{})
+
+	var lastError string
+	waitUntil(t, "the message to be dead lettered", func() bool {
+		return db.QueryRow(`SELECT last_error FROM bus_events_deliveries WHERE dead`).Scan(&lastError) == nil
+	})
+	if n := atomic.LoadInt32(&consumed); n != 0 {
+		t.Fatalf("consumed %d times, want 0", n)
+	}
+}
+
+// A delivery leased by an instance that went away is redelivered once the lease
+// runs out, and not before.
+func TestLeaseExpiry(t *testing.T) {
+	dsn, db := newDSN(t, "")
+	b := open(t, dsn)
+	subscribeGroup(t, db)
+
+	if err := bus.Publish(context.Background(), b, movieRelease, message{}); err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(300 * time.Millisecond)
+	if _, err := db.Exec(`UPDATE bus_events_deliveries SET attempt = 1, locked_until = ?`, until.UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+
+	envs := make(chan bus.Envelope, 1)
+	err := bus.HandleEnvelope(b, movieRelease, func(ctx context.Context, env bus.Envelope, msg message) error {
+		envs <- env
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, db, driver.SubscribeOptions{})
+
+	select {
+	case env := <-envs:
+		if time.Now().Before(until) {
+			t.Fatal("redelivered while still leased")
+		}
+		if env.Attempt != 2 || !env.Redelivered {
+			t.Fatalf("attempt %d redelivered %v, want 2 true", env.Attempt, env.Redelivered)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the redelivery")
+	}
+}
+
+// Deliveries waiting in a lane for longer than their lease are consumed once,
+// not again by whichever claims them after the lease runs out.
+func TestLeaseOutlastsLane(t *testing.T) {
+	dsn, db := newDSN(t, "lease=200ms")
+	b := open(t, dsn)
+	subscribeGroup(t, db)
+
+	const n = 8
+	for i := 0; i < n; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	topic := movieRelease
+	topic.Concurrency = 1
+
+	var (
+		mu   sync.Mutex
+		got  = map[int]int{}
+		done = make(chan struct{})
+	)
+	err := bus.Handle(b, topic, func(ctx context.Context, msg message) error {
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		got[msg.N]++
+		if len(got) == n {
+			close(done)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, db, driver.SubscribeOptions{Workers: 4})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for messages")
+	}
+
+	// let anything claimed twice be consumed again
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Unsubscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, times := range got {
+		if times != 1 {
+			t.Errorf("message %d consumed %d times", i, times)
+		}
+	}
+}
+
+// Deliveries claimed but not yet handed to a worker are released when the
+// subscription stops, for the next to claim straight away.
+func TestPollReleases(t *testing.T) {
+	dsn, db := newDSN(t, "")
+	b := open(t, dsn)
+	subscribeGroup(t, db)
+
+	for i := 0; i < 3; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cn, err := BusDriver{}.OpenConnectorDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cn.(*connector).Close() })
+	dc, err := cn.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dc.(*conn)
+
+	// nothing takes from the queue, so everything claimed is left with poll
+	ctx, cancel := context.WithCancel(context.Background())
+	free := make(slots, 3)
+	polled := make(chan struct{})
+	go func() {
+		c.poll(ctx, free, make(chan job))
+		close(polled)
+	}()
+
+	waitUntil(t, "the deliveries to be claimed", func() bool {
+		var n int
+		db.QueryRow(`SELECT COUNT(*) FROM bus_events_deliveries WHERE locked_until IS NOT NULL`).Scan(&n)
+		return n == 3
+	})
+	cancel()
+	<-polled
+
+	var locked, attempts int
+	err = db.QueryRow(`SELECT COUNT(locked_until), COALESCE(SUM(attempt), 0) FROM bus_events_deliveries`).Scan(&locked, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked != 0 || attempts != 0 {
+		t.Fatalf("%d deliveries left locked, %d attempts counted, want 0 0", locked, attempts)
+	}
+	if len(free) != 0 {
+		t.Fatalf("%d slots left taken", len(free))
+	}
+}
+
+// Unsubscribing consumes what was claimed, leaving nothing leased.
+func TestUnsubscribe(t *testing.T) {
+	dsn, db := newDSN(t, "")
+	b := open(t, dsn)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var consumed int32
+	err := bus.Handle(b, movieRelease, func(ctx context.Context, msg message) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		atomic.AddInt32(&consumed, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(t, b, db, driver.SubscribeOptions{Workers: 2})
+
+	for i := 0; i < 5; i++ {
+		if err := bus.Publish(context.Background(), b, movieRelease, message{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+
+	unsubscribed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		unsubscribed <- b.Unsubscribe(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-unsubscribed; err != nil {
+		t.Fatal(err)
+	}
+
+	var left, locked int
+	err = db.QueryRow(`SELECT COUNT(*), COUNT(locked_until) FROM bus_events_deliveries`).Scan(&left, &locked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked != 0 {
+		t.Fatalf("%d deliveries left leased", locked)
+	}
+	if int(atomic.LoadInt32(&consumed))+left != 5 {
+		t.Fatalf("consumed %d and left %d, want 5 between them", consumed, left)
+	}
+}
@@ -0,0 +1,74 @@
+package sqltable
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+// connector holds the database, which pools its own connections, shared by every
+// driver.Conn handed out.
+type connector struct {
+	cfg config
+	db  *sql.DB
+	q   queries
+	// owned is set when we opened the database, and so close it
+	owned   bool
+	metrics driver.Metrics
+	logger  driver.Logger
+}
+
+func newConnector(db *sql.DB, cfg config, owned bool) (*connector, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("bus name variable is not set, each service needs this set in order to receive its copy of messages")
+	}
+	if err := migrate(context.Background(), db, cfg.Dialect, cfg.Table); err != nil {
+		return nil, err
+	}
+
+	return &connector{
+		cfg:     cfg,
+		db:      db,
+		q:       newQueries(cfg.Dialect, cfg.Table),
+		owned:   owned,
+		metrics: driver.NopMetrics{},
+		logger:  driver.StdLogger{},
+	}, nil
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	consumeCtx, stop := driver.ConsumeContext(ctx)
+	return &conn{
+		cfg:         c.cfg,
+		db:          c.db,
+		q:           c.q,
+		metrics:     c.metrics,
+		logger:      c.logger,
+		consumeCtx:  consumeCtx,
+		stopConsume: stop,
+	}, nil
+}
+
+// SetMetrics implements driver.ConnectorMetrics.
+func (c *connector) SetMetrics(m driver.Metrics) {
+	c.metrics = m
+}
+
+// SetLogger implements driver.ConnectorLogger.
+func (c *connector) SetLogger(l driver.Logger) {
+	c.logger = l
+}
+
+// Close closes the database if it was opened from a DSN.
+func (c *connector) Close() error {
+	if !c.owned {
+		return nil
+	}
+	return c.db.Close()
+}
+
+func (c *connector) Driver() driver.Driver {
+	return BusDriver{}
+}
@@ -0,0 +1,85 @@
+// Package sqltable provides the implementation of the bus/driver interface on a
+// table in a database, through database/sql. It needs no broker, which makes it
+// handy for small deployments and for integration tests that have a database
+// already. Postgres and SQLite are supported.
+//
+// Pushed messages are stored in the events table, along with a row in the
+// deliveries table for every service subscribed to the exchange, the same as a
+// rabbit exchange routing a copy to every bound queue. Subscribers poll for their
+// deliveries, leasing them with a locked_until column (and FOR UPDATE SKIP LOCKED
+// on Postgres, so instances don't block each other), and delete them once
+// consumed. A delivery whose lease runs out, as its consumer crashed, is picked
+// up again by another instance. Only as many are claimed as the workers can take
+// on, and the lease is renewed on one that waited to be started.
+//
+// Request/reply isn't supported, bus.Request fails with bus.ErrRequestUnsupported,
+// as waiting on a reply would mean polling for it.
+//
+// As with database/sql, the database driver is left to the application to
+// import, so it only pulls in the one it uses:
+//
+//	import _ "github.com/lib/pq"           // postgres://
+//	import _ "github.com/mattn/go-sqlite3" // sqlite3://, needs cgo
+package sqltable
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/bus"
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/driver"
+)
+
+type BusDriver struct{}
+
+// OpenConnector always fails, there is no sensible default database.
+func (d BusDriver) OpenConnector() (driver.Connector, error) {
+	return nil, fmt.Errorf("sqltable: a data source name is needed, see ParseDSN")
+}
+
+// OpenConnectorDSN opens the database configured by dsn, see ParseDSN for its
+// format, and creates the tables if they don't exist.
+func (d BusDriver) OpenConnectorDSN(dsn string) (driver.Connector, error) {
+	if dsn == "" {
+		return d.OpenConnector()
+	}
+
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(cfg.Dialect.DriverName(), cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Dialect == SQLite {
+		// SQLite has a single writer, queueing for it in the pool beats failing
+		// with database is locked
+		db.SetMaxOpenConns(1)
+	}
+
+	conn, err := newConnector(db, cfg, true)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// NewConnector returns a connector on a database opened already, to pass to
+// bus.OpenConnector, creating the tables if they don't exist. The options are the
+// query parameters of a DSN, e.g. "name=svc&table=bus_events". The database is
+// not closed with the bus.
+func NewConnector(db *sql.DB, dialect Dialect, options string) (driver.Connector, error) {
+	cfg := NewConfig()
+	cfg.Dialect = dialect
+	if err := cfg.parseOptions(options); err != nil {
+		return nil, err
+	}
+	return newConnector(db, cfg, false)
+}
+
+func init() {
+	bus.Register("sql", &BusDriver{})
+}
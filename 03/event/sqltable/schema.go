@@ -0,0 +1,144 @@
+package sqltable
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/bstncartwright/beyond-database-sql-driver-pattern/03/event/internal/sqldialect"
+)
+
+// Dialect is the flavour of SQL spoken by the database.
+type Dialect = sqldialect.Dialect
+
+const (
+	Postgres = sqldialect.Postgres
+	SQLite   = sqldialect.SQLite
+)
+
+// queries are the statements used by the driver, built for the dialect and
+// table names once up front.
+type queries struct {
+	dialect Dialect
+
+	insertEvent string
+	fanOut      string
+	subscribe   string
+	claim       string
+	extend      string
+	events      string
+	ack         string
+	retry       string
+	dead        string
+	release     string
+	cleanup     string
+}
+
+func newQueries(d Dialect, table string) queries {
+	deliveries := table + "_deliveries"
+	subscriptions := table + "_subscriptions"
+
+	// Postgres can skip deliveries another instance is busy claiming, SQLite has a
+	// single writer so claims never overlap in the first place
+	lock := ""
+	if d == Postgres {
+		lock = " FOR UPDATE SKIP LOCKED"
+	}
+
+	q := queries{
+		dialect: d,
+
+		insertEvent: `INSERT INTO ` + table + ` (exchange, routing_key, message_id, correlation_id,
+causation_id, tenant, headers, content_type, body, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+
+		// every service subscribed to the exchange gets its own delivery
+		fanOut: `INSERT INTO ` + deliveries + ` (group_name, event_id, available_at)
+SELECT group_name, ?, ? FROM ` + subscriptions + ` WHERE exchange = ?`,
+
+		subscribe: `INSERT INTO ` + subscriptions + ` (group_name, exchange) VALUES (?, ?) ON CONFLICT DO NOTHING`,
+
+		claim: `UPDATE ` + deliveries + ` SET attempt = attempt + 1, locked_until = ?
+WHERE id IN (SELECT id FROM ` + deliveries + `
+WHERE group_name = ? AND NOT dead AND available_at <= ? AND (locked_until IS NULL OR locked_until <= ?)
+ORDER BY id LIMIT ?` + lock + `)
+RETURNING id, event_id, attempt`,
+
+		// attempt goes up with every claim, so it only matches our own
+		extend: `UPDATE ` + deliveries + ` SET locked_until = ? WHERE id = ? AND attempt = ? AND NOT dead`,
+
+		events: `SELECT id, exchange, routing_key, message_id, correlation_id, causation_id, tenant,
+headers, content_type, body, created_at FROM ` + table + ` WHERE id IN `,
+
+		ack:     `DELETE FROM ` + deliveries + ` WHERE id = ?`,
+		retry:   `UPDATE ` + deliveries + ` SET available_at = ?, locked_until = NULL, last_error = ? WHERE id = ?`,
+		dead:    `UPDATE ` + deliveries + ` SET dead = TRUE, locked_until = NULL, last_error = ? WHERE id = ?`,
+		release: `UPDATE ` + deliveries + ` SET attempt = attempt - 1, locked_until = NULL WHERE id = ?`,
+
+		cleanup: `DELETE FROM ` + table + ` WHERE created_at < ?
+AND NOT EXISTS (SELECT 1 FROM ` + deliveries + ` WHERE event_id = ` + table + `.id)`,
+	}
+
+	q.insertEvent = q.dialect.Rebind(q.insertEvent)
+	q.fanOut = q.dialect.Rebind(q.fanOut)
+	q.subscribe = q.dialect.Rebind(q.subscribe)
+	q.claim = q.dialect.Rebind(q.claim)
+	q.extend = q.dialect.Rebind(q.extend)
+	q.ack = q.dialect.Rebind(q.ack)
+	q.retry = q.dialect.Rebind(q.retry)
+	q.dead = q.dialect.Rebind(q.dead)
+	q.release = q.dialect.Rebind(q.release)
+	q.cleanup = q.dialect.Rebind(q.cleanup)
+	return q
+}
+
+// eventsIn returns the events query for n IDs.
+func (q queries) eventsIn(n int) string {
+	return q.dialect.Rebind(q.events + "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")")
+}
+
+// migrate creates the tables if they don't exist. Times are stored as unix
+// milliseconds, so they compare the same on every database.
+func migrate(ctx context.Context, db *sql.DB, d Dialect, table string) error {
+	id, blob := d.SerialPrimaryKey(), d.Blob()
+
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (
+	id             ` + id + `,
+	exchange       TEXT NOT NULL,
+	routing_key    TEXT NOT NULL,
+	message_id     TEXT NOT NULL,
+	correlation_id TEXT NOT NULL,
+	causation_id   TEXT NOT NULL,
+	tenant         TEXT NOT NULL,
+	headers        TEXT NOT NULL,
+	content_type   TEXT NOT NULL,
+	body           ` + blob + `,
+	created_at     BIGINT NOT NULL
+)`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_subscriptions (
+	group_name TEXT NOT NULL,
+	exchange   TEXT NOT NULL,
+	PRIMARY KEY (group_name, exchange)
+)`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_deliveries (
+	id           ` + id + `,
+	group_name   TEXT NOT NULL,
+	event_id     BIGINT NOT NULL REFERENCES ` + table + ` (id) ON DELETE CASCADE,
+	attempt      INTEGER NOT NULL DEFAULT 0,
+	available_at BIGINT NOT NULL,
+	locked_until BIGINT,
+	dead         BOOLEAN NOT NULL DEFAULT FALSE,
+	last_error   TEXT NOT NULL DEFAULT ''
+)`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_deliveries_claim ON ` + table + `_deliveries (group_name, available_at)`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("unable to create tables: %w", err)
+		}
+	}
+	return nil
+}